@@ -0,0 +1,112 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CloudflareAccountConditionReadyType             string = "Ready"
+	CloudflareAccountConditionSecretNotFoundReason  string = "SecretNotFound"
+	CloudflareAccountConditionSecretInvalidReason   string = "SecretInvalid"
+	CloudflareAccountConditionTokenInvalidReason    string = "TokenInvalid"
+	CloudflareAccountConditionZoneNotFoundReason    string = "ZoneNotFound"
+	CloudflareAccountConditionVerifiedSuccessReason string = "TokenVerified"
+)
+
+// AllNamespaces can be listed in AllowedNamespaces to allow the account to be used from any namespace
+const AllNamespaces string = "*"
+
+// SecretKeyReference selects a key of a secret
+type SecretKeyReference struct {
+	// Name of the secret
+	Name string `json:"name"`
+
+	// Namespace of the secret. Required by ClusterCloudflareAccount,
+	// a CloudflareAccount always reads the secret from its own namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Key of the secret entry, defaults to CLOUDFLARE_API_TOKEN
+	Key string `json:"key,omitempty"`
+}
+
+// CloudflareAccountSpec defines the desired state of CloudflareAccount and ClusterCloudflareAccount
+type CloudflareAccountSpec struct {
+	// APITokenSecretRef references the secret entry holding the cloudflare API token
+	APITokenSecretRef SecretKeyReference `json:"apiTokenSecretRef"`
+
+	// AccountID is the ID of the cloudflare account in which tunnels are created
+	AccountID string `json:"accountID"`
+
+	// Zones lists the DNS zones managed with this account.
+	// The first zone is the default zone of the tunnels DNS records.
+	Zones []string `json:"zones,omitempty"`
+
+	// AllowedNamespaces lists the namespaces whose Tunnels may use this account, "*" allowing all of them.
+	// A CloudflareAccount can always be used from its own namespace.
+	// A ClusterCloudflareAccount without allowed namespaces cannot be used from any namespace.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+// CloudflareAccountStatus defines the observed state of CloudflareAccount and ClusterCloudflareAccount
+type CloudflareAccountStatus struct {
+	// Conditions represent the latest available observations of the account state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Account",type=string,JSONPath=`.spec.accountID`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CloudflareAccount holds the credentials of a cloudflare account to be used by Tunnels
+type CloudflareAccount struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CloudflareAccountSpec   `json:"spec,omitempty"`
+	Status CloudflareAccountStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// CloudflareAccountList contains a list of CloudflareAccount
+type CloudflareAccountList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CloudflareAccount `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CloudflareAccount{}, &CloudflareAccountList{})
+}
+
+// IsNamespaceAllowed tells whether the Tunnels of the given namespace may use this account
+func (a *CloudflareAccount) IsNamespaceAllowed(namespace string) bool {
+	return namespace == a.Namespace || isNamespaceListed(namespace, a.Spec.AllowedNamespaces)
+}
+
+func isNamespaceListed(namespace string, allowedNamespaces []string) bool {
+	for _, ns := range allowedNamespaces {
+		if ns == namespace || ns == AllNamespaces {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Account",type=string,JSONPath=`.spec.accountID`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterCloudflareAccount holds the credentials of a cloudflare account to be shared by Tunnels across namespaces
+type ClusterCloudflareAccount struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CloudflareAccountSpec   `json:"spec,omitempty"`
+	Status CloudflareAccountStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterCloudflareAccountList contains a list of ClusterCloudflareAccount
+type ClusterCloudflareAccountList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterCloudflareAccount `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterCloudflareAccount{}, &ClusterCloudflareAccountList{})
+}
+
+// IsNamespaceAllowed tells whether the Tunnels of the given namespace may use this account
+func (a *ClusterCloudflareAccount) IsNamespaceAllowed(namespace string) bool {
+	return isNamespaceListed(namespace, a.Spec.AllowedNamespaces)
+}
@@ -17,24 +17,131 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 )
 
 const (
-	TunnelConditionCreatedType          string = "Created"
-	TunnelConditionCreatedFailedReason  string = "CreationFailed"
-	TunnelConditionCreatedExistsReason  string = "AlreadyExists"
-	TunnelConditionCreatedSuccessReason string = "CreationSucceeded"
+	TunnelConditionReadyType            string = "Ready"
+	TunnelConditionReadySuccessReason   string = "TunnelReady"
+	TunnelConditionReadyProgressReason  string = "Progressing"
+	TunnelConditionReadyFailedReason    string = "ConditionsFailed"
+	TunnelConditionDegradedType         string = "Degraded"
+	TunnelConditionDegradedFalseReason  string = "AsExpected"
+	TunnelConditionDegradedFailedReason string = "ConditionsFailed"
+)
+
+const (
+	TunnelConditionCreatedType                 string = "TunnelCreated"
+	TunnelConditionCreatedFailedReason         string = "CreationFailed"
+	TunnelConditionCreatedExistsReason         string = "AlreadyExists"
+	TunnelConditionCreatedSuccessReason        string = "CreationSucceeded"
+	TunnelConditionCreatedAdoptedReason        string = "Adopted"
+	TunnelConditionCreatedAdoptionFailedReason string = "AdoptionFailed"
+	TunnelConditionCreatedRecreatedReason      string = "Recreated"
+	TunnelConditionCreatedAccountChangedReason string = "AccountChanged"
+)
+
+const (
+	TunnelConditionDNSReadyType           string = "DNSReady"
+	TunnelConditionDNSReadySuccessReason  string = "RecordsReady"
+	TunnelConditionDNSReadyFailedReason   string = "RecordsFailed"
+	TunnelConditionDNSReadyNoZoneReason   string = "ZoneNotFound"
+	TunnelConditionDNSReadyConflictReason string = "RecordConflict"
+)
+
+const (
+	TunnelConditionDNSConflictType           string = "DNSConflict"
+	TunnelConditionDNSConflictNoneReason     string = "NoConflict"
+	TunnelConditionDNSConflictDetectedReason string = "RecordsOwnedElsewhere"
+)
+
+const (
+	TunnelConditionConfigSyncedType          string = "ConfigSynced"
+	TunnelConditionConfigSyncedSuccessReason string = "SecretUpdated"
+	TunnelConditionConfigSyncedFailedReason  string = "SecretUpdateFailed"
+
+	TunnelConditionConfigSyncedRemoteSuccessReason string = "RemoteConfigUpdated"
+	TunnelConditionConfigSyncedRemoteFailedReason  string = "RemoteConfigUpdateFailed"
+	TunnelConditionConfigSyncedRemoteActiveReason  string = "RemoteConfigActive"
+)
+
+const (
+	TunnelConditionConnectorAvailableType              string = "ConnectorAvailable"
+	TunnelConditionConnectorAvailableSuccessReason     string = "DeploymentAvailable"
+	TunnelConditionConnectorAvailableProgressingReason string = "DeploymentProgressing"
+	TunnelConditionConnectorAvailableFailedReason      string = "DeploymentUnavailable"
+	TunnelConditionConnectorAvailableNotRunReason      string = "RunDisabled"
+)
+
+const (
+	TunnelConditionConnectedType           string = "Connected"
+	TunnelConditionConnectedSuccessReason  string = "ConnectorsConnected"
+	TunnelConditionConnectedAwaitingReason string = "AwaitingConnections"
+	TunnelConditionConnectedNoneReason     string = "NoConnections"
+	TunnelConditionConnectedFailedReason   string = "PollFailed"
+)
+
+const (
+	TunnelConditionBoundType           string = "Bound"
+	TunnelConditionBoundSuccessReason  string = "TunnelFound"
+	TunnelConditionBoundNotFoundReason string = "TunnelNotFound"
+	TunnelConditionBoundDeletedReason  string = "TunnelDeleted"
+	TunnelConditionBoundRenamedReason  string = "TunnelRenamed"
+)
+
+const (
+	TunnelConditionDriftedType            string = "Drifted"
+	TunnelConditionDriftedInSyncReason    string = "InSync"
+	TunnelConditionDriftedDetectedReason  string = "DriftDetected"
+	TunnelConditionDriftedCorrectedReason string = "DriftCorrected"
+)
+
+const (
+	TunnelConditionCredentialsType           string = "CredentialsResolved"
+	TunnelConditionCredentialsNotFoundReason string = "SecretNotFound"
+	TunnelConditionCredentialsInvalidReason  string = "SecretInvalid"
+	TunnelConditionCredentialsSuccessReason  string = "SecretResolved"
+
+	TunnelConditionCredentialsAccountNotFoundReason   string = "AccountNotFound"
+	TunnelConditionCredentialsAccountNotAllowedReason string = "AccountNotAllowed"
+	TunnelConditionCredentialsAccountNotReadyReason   string = "AccountNotReady"
+)
+
+const (
+	CloudflareAccountKind        string = "CloudflareAccount"
+	ClusterCloudflareAccountKind string = "ClusterCloudflareAccount"
 )
 
 const (
 	TunnelDefaultRun bool = false
 )
 
+const (
+	// TunnelConfigSourceLocal runs cloudflared with the configuration written in the tunnel secret
+	TunnelConfigSourceLocal string = "local"
+	// TunnelConfigSourceCloudflare pushes the configuration to cloudflare and runs cloudflared with the tunnel token
+	TunnelConfigSourceCloudflare string = "cloudflare"
+)
+
+const (
+	// TunnelRotateSecretAnnotation requests the rotation of the tunnel secret when set to a new value, e.g. a timestamp
+	TunnelRotateSecretAnnotation string = "tunnel.zeeweb.xyz/rotate-secret"
+	// TunnelSecretRotationAnnotation is set on the pod template of the deployment to roll it after a secret rotation
+	TunnelSecretRotationAnnotation string = "tunnel.zeeweb.xyz/secret-rotation"
+	// TunnelConfigHashAnnotation is set on the pod template of the deployment to the hash of the configuration and
+	// credentials of the tunnel, to roll it when they change
+	TunnelConfigHashAnnotation string = "tunnel.zeeweb.xyz/config-hash"
+)
+
 // copied from https://github.com/cloudflare/cloudflared/blob/master/config/configuration.go
 // OriginRequestConfig is a set of optional fields that users may set to
 // customize how cloudflared sends requests to origin services. It is used to set
@@ -91,12 +198,81 @@ type TunnelIngress struct {
 	// Important: Run "make" to regenerate code after modifying this file
 
 	// HostName is the hostname that can be used to reach this tunnel ingress
-	HostName      string               `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	HostName string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	// Zone is the name of the DNS zone holding the CNAME record of HostName. It defaults to the zone with the
+	// longest name HostName ends with, among the zones accessible with the cloudflare credentials.
+	// +optional
+	Zone string `json:"zone,omitempty" yaml:"-"`
+	// DNS customizes the CNAME record of HostName
+	// +optional
+	DNS           *TunnelIngressDNS    `json:"dns,omitempty" yaml:"-"`
 	Path          *string              `json:"path,omitempty" yaml:"path,omitempty"`
 	Service       *string              `json:"service,omitempty" yaml:"service,omitempty"`
 	OriginRequest *OriginRequestConfig `json:"originRequest,omitempty" yaml:"originRequest,omitempty"`
 }
 
+// TunnelIngressDNS customizes the CNAME record of an ingress hostname
+type TunnelIngressDNS struct {
+	// Skip leaves the DNS record of the hostname to be managed elsewhere: the operator neither creates,
+	// updates nor deletes it
+	// +optional
+	Skip bool `json:"skip,omitempty"`
+
+	// Proxied sets whether the traffic to the hostname goes through cloudflare, defaults to true
+	// +optional
+	Proxied *bool `json:"proxied,omitempty"`
+
+	// TTL is the time to live of the record in seconds, 1 meaning automatic.
+	// Proxied records always have an automatic TTL.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TTL int `json:"ttl,omitempty"`
+
+	// Comment is the comment of the record
+	// +optional
+	Comment string `json:"comment,omitempty"`
+
+	// Tags are the tags of the record, formatted as name:value
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+}
+
+const (
+	// TunnelDeletionPolicyRetain leaves an adopted tunnel in cloudflare when its Tunnel is deleted
+	TunnelDeletionPolicyRetain string = "Retain"
+	// TunnelDeletionPolicyDelete deletes an adopted tunnel from cloudflare along with its Tunnel
+	TunnelDeletionPolicyDelete string = "Delete"
+)
+
+// TunnelAdoption allows to manage a tunnel created outside of the operator, e.g. with `cloudflared tunnel create`
+type TunnelAdoption struct {
+	// SecretName is the name of a secret, in the Tunnel namespace, holding the credentials of the existing tunnel:
+	// either a credentials.json key as written by `cloudflared tunnel create`, or a tunnelSecret key with the base64 tunnel secret
+	SecretName string `json:"secretName"`
+
+	// DeletionPolicy tells whether the adopted tunnel is deleted from cloudflare along with the Tunnel.
+	// It is retained by default, as it was not created by the operator.
+	// +kubebuilder:validation:Enum=Retain;Delete
+	// +kubebuilder:default=Retain
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+// AccountReference references a CloudflareAccount or a ClusterCloudflareAccount
+type AccountReference struct {
+	// Kind of the referenced account
+	// +kubebuilder:validation:Enum=CloudflareAccount;ClusterCloudflareAccount
+	// +kubebuilder:default=CloudflareAccount
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the referenced account
+	Name string `json:"name"`
+
+	// Namespace of the referenced CloudflareAccount, defaults to the Tunnel namespace.
+	// The account must allow the Tunnel namespace when it lives in another namespace.
+	Namespace string `json:"namespace,omitempty"`
+}
+
 // TunnelSpec defines the desired state of Tunnel
 type TunnelSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
@@ -104,17 +280,106 @@ type TunnelSpec struct {
 	// Name is the name of the tunnel to create
 	Name string `json:"name"`
 
-	// AccountSecret is a reference to a secret containing the cloudflare account API token
+	// TunnelID binds this Tunnel to the cloudflare tunnel with this exact ID, which must be named after spec.name.
+	// The tunnel is never recreated: when it gets deleted or renamed out-of-band, the Bound condition reports it.
+	// Binding to a tunnel not created by this Tunnel requires spec.adopt.
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+	TunnelID string `json:"tunnelID,omitempty"`
+
+	// AccountRef references the CloudflareAccount or ClusterCloudflareAccount to manage this tunnel with.
+	// It takes precedence over AccountSecret.
+	AccountRef *AccountReference `json:"accountRef,omitempty"`
+
+	// AccountSecret is a reference to a secret, in the Tunnel namespace, containing the cloudflare account credentials.
+	// The secret must define the CLOUDFLARE_API_TOKEN and CLOUDFLARE_ACCOUNT_ID keys, and optionally CLOUDFLARE_ZONE_NAME.
+	// When not set, the operator environment variables of the same names are used.
 	AccountSecret *corev1.SecretReference `json:"accountSecret,omitempty"`
 
 	// TunnelSecret is a reference to the secret to create with the tunnel information
 	// TunnelSecret *corev1.SecretReference `json:"secret,omitempty"`
 	TunnelSecretName *string `json:"secretName,omitempty"`
 
+	// Adopt brings an existing cloudflare tunnel named after spec.name under the management of this Tunnel,
+	// instead of reporting that it already exists. The adopted tunnel is retained when the Tunnel is deleted,
+	// unless adopt.deletionPolicy is Delete.
+	Adopt *TunnelAdoption `json:"adopt,omitempty"`
+
 	Ingress *[]TunnelIngress `json:"ingress,omitempty"`
 
-	Run            bool                   `json:"run,omitempty"`
+	// ConfigSource is where cloudflared reads the ingress rules from: local writes them in the config.yaml of the
+	// tunnel secret, cloudflare pushes them to the remote configuration of the tunnel, applied by the connectors
+	// without restarting them. A tunnel configured from cloudflare cannot be configured locally anymore.
+	// +kubebuilder:validation:Enum=local;cloudflare
+	// +kubebuilder:default=local
+	// +optional
+	ConfigSource string `json:"configSource,omitempty"`
+
+	Run bool `json:"run,omitempty"`
+
+	// Replicas is the number of cloudflared replicas run with run: true, 1 by default.
+	// It should be left unset when the deployment is scaled by an autoscaler.
+	// +kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// PodTemplate is merged into the pod template of the cloudflared deployment computed by the operator, as a
+	// strategic merge patch: containers and volumes are merged by name, e.g. the cloudflared container is customized
+	// by a container named cloudflared.
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+
+	// ManualRollout stops rolling the cloudflared deployment when the configuration or the credentials of the tunnel
+	// change: the pods have to be restarted to use them. A secret rotation still rolls the deployment.
+	ManualRollout bool `json:"manualRollout,omitempty"`
+
+	// SecretEnvFile adds a tunnel.env key to the tunnel secret, an environment file setting TUNNEL_TOKEN to run the
+	// tunnel with cloudflared outside of the cluster
+	SecretEnvFile bool `json:"secretEnvFile,omitempty"`
+
+	// DeploymentSpec replaces the whole spec of the cloudflared deployment computed by the operator.
+	// The default deployment spec written back by older operator versions is ignored.
+	// Deprecated: use replicas and podTemplate, which keep the defaults of the operator up to date.
 	DeploymentSpec *appsv1.DeploymentSpec `json:"deploymentSpec,omitempty"`
+
+	// ResyncPeriod overrides the operator --tunnel-resync-period, after which the tunnel and its DNS records are
+	// verified against cloudflare even when nothing changed in the cluster. Zero disables the periodic verification.
+	ResyncPeriod *metav1.Duration `json:"resyncPeriod,omitempty"`
+
+	// CorrectDrift reverts the changes made out-of-band to the DNS records of the tunnel, instead of only reporting them
+	// in the Drifted condition
+	CorrectDrift bool `json:"correctDrift,omitempty"`
+}
+
+// TunnelConnection is a connection of a cloudflared connector to the cloudflare edge
+type TunnelConnection struct {
+	// ID is the ID of the connection
+	ID string `json:"id"`
+
+	// ConnectorID is the ID of the cloudflared instance holding the connection
+	ConnectorID string `json:"connectorID"`
+
+	// ColoName is the name of the cloudflare data center the connector is connected to
+	ColoName string `json:"coloName,omitempty"`
+
+	// ClientVersion is the version of cloudflared
+	ClientVersion string `json:"clientVersion,omitempty"`
+
+	// OriginIP is the IP address the connector connects from
+	OriginIP string `json:"originIP,omitempty"`
+
+	// OpenedAt is the time at which the connection was opened
+	OpenedAt *metav1.Time `json:"openedAt,omitempty"`
+
+	// IsPendingReconnect is set when the connection is being re-established
+	IsPendingReconnect bool `json:"isPendingReconnect,omitempty"`
+}
+
+// TunnelDNSZone is the DNS zone holding the CNAME record of a hostname
+type TunnelDNSZone struct {
+	// Hostname is the name of the CNAME record
+	Hostname string `json:"hostname"`
+	// ZoneID is the ID of the zone holding the record
+	ZoneID string `json:"zoneID"`
+	// ZoneName is the name of the zone holding the record
+	ZoneName string `json:"zoneName,omitempty"`
 }
 
 // TunnelStatus defines the observed state of Tunnel
@@ -132,10 +397,41 @@ type TunnelStatus struct {
 
 	// IngressHostnames lists the hostnames recorded in DNS
 	IngressHostnames []string `json:"hostnames,omitempty"`
+
+	// DNSZones lists the zone of each of the IngressHostnames
+	DNSZones []TunnelDNSZone `json:"dnsZones,omitempty"`
+
+	// UnresolvedHostnames lists the ingress hostnames belonging to no zone accessible with the cloudflare credentials
+	UnresolvedHostnames []string `json:"unresolvedHostnames,omitempty"`
+
+	// Connections lists the connections of the tunnel reported by the cloudflare edge
+	Connections []TunnelConnection `json:"connections,omitempty"`
+
+	// ActiveConnections is the number of connections which are not pending a reconnection
+	ActiveConnections int32 `json:"activeConnections,omitempty"`
+
+	// DisconnectedSince is the time since which the cloudflare edge reports no active connection
+	DisconnectedSince *metav1.Time `json:"disconnectedSince,omitempty"`
+
+	// ObservedGeneration is the generation of the Tunnel which was last reconciled completely
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Adopted is set when the cloudflare tunnel was adopted rather than created by this Tunnel
+	Adopted bool `json:"adopted,omitempty"`
+
+	// SecretRotation is the value of the rotate-secret annotation for which the tunnel secret was last rotated
+	SecretRotation string `json:"secretRotation,omitempty"`
+
+	// RemoteConfigHash is the hash of the configuration last pushed to cloudflare with configSource: cloudflare
+	RemoteConfigHash string `json:"remoteConfigHash,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Tunnel ID",type=string,JSONPath=`.status.tunnelid`
+//+kubebuilder:printcolumn:name="Connections",type=integer,JSONPath=`.status.activeConnections`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Tunnel is the Schema for the tunnels API
 type Tunnel struct {
@@ -172,17 +468,65 @@ func (t *Tunnel) BaseTunnelSecret() *corev1.Secret {
 	}
 }
 
-func (t *Tunnel) DefaultDeploymentSpec() appsv1.DeploymentSpec {
+// DefaultCloudflaredImage is the cloudflared image run by default with run: true.
+// It must read the tunnel token from TUNNEL_TOKEN.
+const DefaultCloudflaredImage = "cloudflare/cloudflared:2022.10.3"
+
+// RetainsTunnel returns whether the cloudflare tunnel is left in place when the Tunnel is deleted: an adopted tunnel
+// is retained unless its deletion policy is Delete
+func (t *Tunnel) RetainsTunnel() bool {
+	if !t.Status.Adopted {
+		return false
+	}
+	return t.Spec.Adopt == nil || t.Spec.Adopt.DeletionPolicy != TunnelDeletionPolicyDelete
+}
+
+// IsRemotelyConfigured returns whether the configuration of the tunnel is pushed to cloudflare
+func (t *Tunnel) IsRemotelyConfigured() bool {
+	return t.Spec.ConfigSource == TunnelConfigSourceCloudflare
+}
+
+const (
+	// TunnelSecretTokenKey is the key of the tunnel token in the tunnel secret
+	TunnelSecretTokenKey = "token"
+	// TunnelSecretEnvFileKey is the key of the environment file setting TUNNEL_TOKEN in the tunnel secret
+	TunnelSecretEnvFileKey = "tunnel.env"
+)
+
+// DefaultDeploymentSpec returns the spec of the deployment running the tunnel with the cloudflared image,
+// DefaultCloudflaredImage when empty. The tunnel is run with its token, and a locally configured tunnel with the
+// config.yaml of the tunnel secret.
+func (t *Tunnel) DefaultDeploymentSpec(image string) appsv1.DeploymentSpec {
+	if image == "" {
+		image = DefaultCloudflaredImage
+	}
 	labelSelector := t.DefaultDeploymentLabelSelector()
-	var replicas int32 = 1
 	var optionalOpenshitCA = true
 	var secretName = t.Name
 	if t.Spec.TunnelSecretName != nil {
 		secretName = *t.Spec.TunnelSecretName
 	}
 
+	// cloudflared reads the token of the tunnel from TUNNEL_TOKEN, and its ingress rules from the remote configuration
+	// of the tunnel or from the config.yaml of the tunnel secret
+	args := []string{
+		"tunnel",
+		"--no-autoupdate",
+		"--config", "/config/config.yaml",
+		"--metrics", "0.0.0.0:10000",
+		"run",
+	}
+	if t.IsRemotelyConfigured() {
+		args = []string{
+			"tunnel",
+			"--no-autoupdate",
+			"--metrics", "0.0.0.0:10000",
+			"run",
+		}
+	}
+
+	// the replicas are left to the deployment defaults unless set in the Tunnel, e.g. when scaled by an autoscaler
 	return appsv1.DeploymentSpec{
-		Replicas: &replicas,
 		Selector: &metav1.LabelSelector{
 			MatchLabels: labelSelector,
 		},
@@ -192,15 +536,18 @@ func (t *Tunnel) DefaultDeploymentSpec() appsv1.DeploymentSpec {
 			},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{{
-					Image: "cloudflare/cloudflared:2022.1.3",
+					Image: image,
 					Name:  "cloudflared",
-					Args: []string{
-						"tunnel",
-						"--config", "/config/config.yaml",
-						"--metrics", "0.0.0.0:10000",
-						"run",
-						"--credentials-file", "/config/credentials.json",
-					},
+					Args:  args,
+					Env: []corev1.EnvVar{{
+						Name: "TUNNEL_TOKEN",
+						ValueFrom: &corev1.EnvVarSource{
+							SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+								Key:                  TunnelSecretTokenKey,
+							},
+						},
+					}},
 					Ports: []corev1.ContainerPort{{
 						Name:          "metrics",
 						ContainerPort: 10000,
@@ -248,15 +595,32 @@ func (t *Tunnel) DefaultDeploymentLabelSelector() map[string]string {
 	return map[string]string{"app": "cloudflared-run", "tunnel-id": t.Status.TunnelID}
 }
 
-func (t *Tunnel) DeploymentForTunnelRun() *appsv1.Deployment {
+// DeploymentForTunnelRun returns the deployment running the tunnel: the default deployment running the cloudflared
+// image, with the replicas and pod template of the spec merged into it. It is computed on each reconciliation
+// and never written back into the Tunnel, so that the defaults follow the operator.
+func (t *Tunnel) DeploymentForTunnelRun(image string) (*appsv1.Deployment, error) {
 	labels := t.DefaultDeploymentLabelSelector()
 
-	deploymentSpec := t.DefaultDeploymentSpec()
-	if t.Spec.DeploymentSpec != nil {
-		deploymentSpec = *t.Spec.DeploymentSpec
-		deploymentSpec.Selector.MatchLabels = labels
-		deploymentSpec.Template.ObjectMeta.Labels = labels
+	deploymentSpec := t.DefaultDeploymentSpec(image)
+	if t.Spec.DeploymentSpec != nil && !t.HasLegacyDeploymentSpec() {
+		deploymentSpec = *t.Spec.DeploymentSpec.DeepCopy()
+		if deploymentSpec.Selector == nil {
+			deploymentSpec.Selector = &metav1.LabelSelector{}
+		}
 	}
+	if t.Spec.Replicas != nil {
+		replicas := *t.Spec.Replicas
+		deploymentSpec.Replicas = &replicas
+	}
+	if t.Spec.PodTemplate != nil {
+		template, err := mergePodTemplate(deploymentSpec.Template, *t.Spec.PodTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid podTemplate: %w", err)
+		}
+		deploymentSpec.Template = template
+	}
+	deploymentSpec.Selector.MatchLabels = labels
+	deploymentSpec.Template.ObjectMeta.Labels = mergeLabels(deploymentSpec.Template.ObjectMeta.Labels, labels)
 
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -266,5 +630,104 @@ func (t *Tunnel) DeploymentForTunnelRun() *appsv1.Deployment {
 		},
 		Spec: deploymentSpec,
 	}
-	return dep
+	return dep, nil
+}
+
+// legacyCloudflaredImage is the image repository of the deployment spec written back into the Tunnels by the
+// operator versions computing it once, its tag followed the operator releases
+const legacyCloudflaredImage = "cloudflare/cloudflared:"
+
+// HasLegacyDeploymentSpec tells whether the deploymentSpec of the Tunnel is the default deployment spec written back
+// by older operator versions rather than a user customization. It is ignored so that the Tunnel gets the current
+// defaults of the operator.
+func (t *Tunnel) HasLegacyDeploymentSpec() bool {
+	if t.Spec.DeploymentSpec == nil {
+		return false
+	}
+	spec := t.Spec.DeploymentSpec.DeepCopy()
+	legacy := t.legacyDeploymentSpec()
+	// the labels are always set by the operator
+	spec.Selector = legacy.Selector
+	spec.Template.ObjectMeta.Labels = legacy.Template.ObjectMeta.Labels
+	if len(spec.Template.Spec.Containers) == 1 &&
+		strings.HasPrefix(spec.Template.Spec.Containers[0].Image, legacyCloudflaredImage) {
+		spec.Template.Spec.Containers[0].Image = legacy.Template.Spec.Containers[0].Image
+	}
+	return apiequality.Semantic.DeepEqual(*spec, legacy)
+}
+
+// legacyDeploymentSpec returns the default deployment spec of the operator versions writing it into the Tunnel,
+// running cloudflared with the credentials file of the tunnel secret
+func (t *Tunnel) legacyDeploymentSpec() appsv1.DeploymentSpec {
+	var replicas int32 = 1
+	spec := t.DefaultDeploymentSpec(legacyCloudflaredImage + "2022.1.3")
+	spec.Replicas = &replicas
+	container := &spec.Template.Spec.Containers[0]
+	container.Args = []string{
+		"tunnel",
+		"--config", "/config/config.yaml",
+		"--metrics", "0.0.0.0:10000",
+		"run",
+		"--credentials-file", "/config/credentials.json",
+	}
+	container.Env = nil
+	return spec
+}
+
+// mergePodTemplate applies overlay to base as a strategic merge patch
+func mergePodTemplate(base, overlay corev1.PodTemplateSpec) (corev1.PodTemplateSpec, error) {
+	merged := corev1.PodTemplateSpec{}
+	original, err := json.Marshal(base)
+	if err != nil {
+		return merged, err
+	}
+	patch, err := json.Marshal(overlay)
+	if err != nil {
+		return merged, err
+	}
+	// the unset fields of overlay are marshalled as null, which deletes them in a strategic merge patch
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return merged, err
+	}
+	removeNulls(fields)
+	if patch, err = json.Marshal(fields); err != nil {
+		return merged, err
+	}
+	result, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return merged, err
+	}
+	err = json.Unmarshal(result, &merged)
+	return merged, err
+}
+
+// removeNulls removes the null fields of the JSON objects in value
+func removeNulls(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if field == nil {
+				delete(v, key)
+				continue
+			}
+			removeNulls(field)
+		}
+	case []interface{}:
+		for _, item := range v {
+			removeNulls(item)
+		}
+	}
+}
+
+// mergeLabels returns the labels with the selector labels, which take precedence
+func mergeLabels(labels, selector map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range selector {
+		merged[k] = v
+	}
+	return merged
 }
@@ -23,12 +23,193 @@ package v1alpha1
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
-	"k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	timex "time"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountReference) DeepCopyInto(out *AccountReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountReference.
+func (in *AccountReference) DeepCopy() *AccountReference {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareAccount) DeepCopyInto(out *CloudflareAccount) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareAccount.
+func (in *CloudflareAccount) DeepCopy() *CloudflareAccount {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareAccount)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CloudflareAccount) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareAccountList) DeepCopyInto(out *CloudflareAccountList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CloudflareAccount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareAccountList.
+func (in *CloudflareAccountList) DeepCopy() *CloudflareAccountList {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareAccountList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CloudflareAccountList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareAccountSpec) DeepCopyInto(out *CloudflareAccountSpec) {
+	*out = *in
+	out.APITokenSecretRef = in.APITokenSecretRef
+	if in.Zones != nil {
+		in, out := &in.Zones, &out.Zones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedNamespaces != nil {
+		in, out := &in.AllowedNamespaces, &out.AllowedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareAccountSpec.
+func (in *CloudflareAccountSpec) DeepCopy() *CloudflareAccountSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareAccountSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudflareAccountStatus) DeepCopyInto(out *CloudflareAccountStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudflareAccountStatus.
+func (in *CloudflareAccountStatus) DeepCopy() *CloudflareAccountStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudflareAccountStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterCloudflareAccount) DeepCopyInto(out *ClusterCloudflareAccount) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterCloudflareAccount.
+func (in *ClusterCloudflareAccount) DeepCopy() *ClusterCloudflareAccount {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterCloudflareAccount)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterCloudflareAccount) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterCloudflareAccountList) DeepCopyInto(out *ClusterCloudflareAccountList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterCloudflareAccount, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterCloudflareAccountList.
+func (in *ClusterCloudflareAccountList) DeepCopy() *ClusterCloudflareAccountList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterCloudflareAccountList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterCloudflareAccountList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IngressIPRule) DeepCopyInto(out *IngressIPRule) {
 	*out = *in
@@ -151,6 +332,21 @@ func (in *OriginRequestConfig) DeepCopy() *OriginRequestConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretKeyReference) DeepCopyInto(out *SecretKeyReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretKeyReference.
+func (in *SecretKeyReference) DeepCopy() *SecretKeyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretKeyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Tunnel) DeepCopyInto(out *Tunnel) {
 	*out = *in
@@ -178,9 +374,63 @@ func (in *Tunnel) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelAdoption) DeepCopyInto(out *TunnelAdoption) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelAdoption.
+func (in *TunnelAdoption) DeepCopy() *TunnelAdoption {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelAdoption)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelConnection) DeepCopyInto(out *TunnelConnection) {
+	*out = *in
+	if in.OpenedAt != nil {
+		in, out := &in.OpenedAt, &out.OpenedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelConnection.
+func (in *TunnelConnection) DeepCopy() *TunnelConnection {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelConnection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelDNSZone) DeepCopyInto(out *TunnelDNSZone) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelDNSZone.
+func (in *TunnelDNSZone) DeepCopy() *TunnelDNSZone {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelDNSZone)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelIngress) DeepCopyInto(out *TunnelIngress) {
 	*out = *in
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = new(TunnelIngressDNS)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Path != nil {
 		in, out := &in.Path, &out.Path
 		*out = new(string)
@@ -208,6 +458,31 @@ func (in *TunnelIngress) DeepCopy() *TunnelIngress {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelIngressDNS) DeepCopyInto(out *TunnelIngressDNS) {
+	*out = *in
+	if in.Proxied != nil {
+		in, out := &in.Proxied, &out.Proxied
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelIngressDNS.
+func (in *TunnelIngressDNS) DeepCopy() *TunnelIngressDNS {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelIngressDNS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelList) DeepCopyInto(out *TunnelList) {
 	*out = *in
@@ -243,9 +518,14 @@ func (in *TunnelList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelSpec) DeepCopyInto(out *TunnelSpec) {
 	*out = *in
+	if in.AccountRef != nil {
+		in, out := &in.AccountRef, &out.AccountRef
+		*out = new(AccountReference)
+		**out = **in
+	}
 	if in.AccountSecret != nil {
 		in, out := &in.AccountSecret, &out.AccountSecret
-		*out = new(v1.SecretReference)
+		*out = new(corev1.SecretReference)
 		**out = **in
 	}
 	if in.TunnelSecretName != nil {
@@ -253,6 +533,11 @@ func (in *TunnelSpec) DeepCopyInto(out *TunnelSpec) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.Adopt != nil {
+		in, out := &in.Adopt, &out.Adopt
+		*out = new(TunnelAdoption)
+		**out = **in
+	}
 	if in.Ingress != nil {
 		in, out := &in.Ingress, &out.Ingress
 		*out = new([]TunnelIngress)
@@ -264,11 +549,26 @@ func (in *TunnelSpec) DeepCopyInto(out *TunnelSpec) {
 			}
 		}
 	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(corev1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.DeploymentSpec != nil {
 		in, out := &in.DeploymentSpec, &out.DeploymentSpec
 		*out = new(appsv1.DeploymentSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ResyncPeriod != nil {
+		in, out := &in.ResyncPeriod, &out.ResyncPeriod
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelSpec.
@@ -286,7 +586,7 @@ func (in *TunnelStatus) DeepCopyInto(out *TunnelStatus) {
 	*out = *in
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]metav1.Condition, len(*in))
+		*out = make([]v1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -296,6 +596,27 @@ func (in *TunnelStatus) DeepCopyInto(out *TunnelStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.DNSZones != nil {
+		in, out := &in.DNSZones, &out.DNSZones
+		*out = make([]TunnelDNSZone, len(*in))
+		copy(*out, *in)
+	}
+	if in.UnresolvedHostnames != nil {
+		in, out := &in.UnresolvedHostnames, &out.UnresolvedHostnames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Connections != nil {
+		in, out := &in.Connections, &out.Connections
+		*out = make([]TunnelConnection, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DisconnectedSince != nil {
+		in, out := &in.DisconnectedSince, &out.DisconnectedSince
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelStatus.
@@ -0,0 +1,142 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/cloudflare/cloudflare-go"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+const (
+	adoptSecretCredentialsKey  = "credentials.json"
+	adoptSecretTunnelSecretKey = "tunnelSecret"
+)
+
+// tunnelCredentials is the content of the cloudflared credentials.json file
+type tunnelCredentials struct {
+	AccountTag   string
+	TunnelID     string
+	TunnelName   string
+	TunnelSecret string
+}
+
+// adoptionError reports why an existing tunnel cannot be adopted
+type adoptionError struct {
+	Message string
+}
+
+func (e *adoptionError) Error() string {
+	return e.Message
+}
+
+// adoptedTunnelSecret returns the base64 secret of the existing tunnel from the adoption secret of t,
+// or an adoptionError when the secret is missing or holds the credentials of another tunnel
+func (r *TunnelReconciler) adoptedTunnelSecret(ctx context.Context, t *tunnelv1alpha1.Tunnel, existing cloudflare.ArgoTunnel, accountID string) (string, error) {
+	name := t.Spec.Adopt.SecretName
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: t.Namespace, Name: name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", &adoptionError{Message: "adoption secret " + name + " not found"}
+		}
+		return "", err
+	}
+
+	tunnelSecret := string(secret.Data[adoptSecretTunnelSecretKey])
+	if data, ok := secret.Data[adoptSecretCredentialsKey]; ok {
+		credentials := tunnelCredentials{}
+		if err := json.Unmarshal(data, &credentials); err != nil {
+			return "", &adoptionError{Message: "adoption secret " + name + " has an invalid " + adoptSecretCredentialsKey + ": " + err.Error()}
+		}
+		if credentials.TunnelID != "" && credentials.TunnelID != existing.ID {
+			return "", &adoptionError{Message: "adoption secret " + name + " holds the credentials of tunnel " +
+				credentials.TunnelID + ", not of the existing tunnel " + existing.ID}
+		}
+		if credentials.AccountTag != "" && credentials.AccountTag != accountID {
+			return "", &adoptionError{Message: "adoption secret " + name + " holds the credentials of account " +
+				credentials.AccountTag + ", not of account " + accountID}
+		}
+		tunnelSecret = credentials.TunnelSecret
+	}
+	if tunnelSecret == "" {
+		return "", &adoptionError{Message: "adoption secret " + name + " is missing key " +
+			adoptSecretCredentialsKey + " or " + adoptSecretTunnelSecretKey}
+	}
+	if _, err := b64.StdEncoding.DecodeString(tunnelSecret); err != nil {
+		return "", &adoptionError{Message: "adoption secret " + name + " holds a tunnel secret which is not base64 encoded"}
+	}
+	return tunnelSecret, nil
+}
+
+// adoptTunnel records an existing cloudflare tunnel in the status of t and writes its credentials in the tunnel secret.
+// An existing tunnel secret is taken over, so that a cloudflared already running with it keeps working.
+func (r *TunnelReconciler) adoptTunnel(ctx context.Context, t *tunnelv1alpha1.Tunnel, existing cloudflare.ArgoTunnel, accountID string) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+
+	secretB64, err := r.adoptedTunnelSecret(ctx, t, existing, accountID)
+	if err != nil {
+		var adoptErr *adoptionError
+		if !errors.As(err, &adoptErr) {
+			log.Error(err, "Failed to read adoption secret")
+			return ctrl.Result{}, err
+		}
+		log.Error(err, "cannot adopt cloudflare tunnel "+existing.ID)
+		setTunnelCondition(t,
+			metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionCreatedType,
+				Status:  metav1.ConditionFalse,
+				Reason:  tunnelv1alpha1.TunnelConditionCreatedAdoptionFailedReason,
+				Message: "Cloudflare tunnel adoption failed: " + adoptErr.Message,
+			})
+		// the adoption secret is watched: the tunnel is reconciled again once it gets fixed
+		err := r.updateStatus(ctx, t)
+		return ctrl.Result{}, err
+	}
+
+	log.Info("adopting cloudflare tunnel " + existing.ID)
+	t.Status.AccountID = accountID
+	t.Status.TunnelID = existing.ID
+	t.Status.Adopted = true
+	if err := r.writeTunnelSecret(ctx, t, secretB64); err != nil {
+		log.Error(err, "Failed to write tunnel secret")
+		return ctrl.Result{}, err
+	}
+	setTunnelCondition(t,
+		metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionCreatedType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionCreatedAdoptedReason,
+			Message: "Cloudflare tunnel adopted with ID " + existing.ID,
+		})
+	if err := r.updateStatus(ctx, t); err != nil {
+		log.Error(err, "Failed to update Tunnel status")
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(t, corev1.EventTypeNormal, "TunnelAdopted", "Adopted existing cloudflare tunnel "+existing.ID)
+	return ctrl.Result{}, nil
+}
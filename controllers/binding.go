@@ -0,0 +1,68 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/cloudflare/cloudflare-go"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// tunnelBinding checks that the cloudflare tunnel with the ID in the spec of t still exists with the expected name.
+// It returns the Bound condition of t, and the bound tunnel which is nil when the tunnel drifted.
+func tunnelBinding(t *tunnelv1alpha1.Tunnel, cfTunnels []cloudflare.ArgoTunnel) (metav1.Condition, *cloudflare.ArgoTunnel) {
+	condition := metav1.Condition{
+		Type:   tunnelv1alpha1.TunnelConditionBoundType,
+		Status: metav1.ConditionFalse,
+	}
+	id := t.Spec.TunnelID
+	for i := range cfTunnels {
+		cfTunnel := &cfTunnels[i]
+		if cfTunnel.ID != id {
+			continue
+		}
+		switch {
+		case cfTunnel.DeletedAt != nil:
+			condition.Reason = tunnelv1alpha1.TunnelConditionBoundDeletedReason
+			condition.Message = "Cloudflare tunnel " + id + " was deleted on " + cfTunnel.DeletedAt.UTC().Format("2006-01-02T15:04:05Z")
+		case cfTunnel.Name != t.Spec.Name:
+			condition.Reason = tunnelv1alpha1.TunnelConditionBoundRenamedReason
+			condition.Message = "Cloudflare tunnel " + id + " is named " + cfTunnel.Name + " instead of " + t.Spec.Name
+		default:
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = tunnelv1alpha1.TunnelConditionBoundSuccessReason
+			condition.Message = "Bound to cloudflare tunnel " + id
+			return condition, cfTunnel
+		}
+		return condition, nil
+	}
+	condition.Reason = tunnelv1alpha1.TunnelConditionBoundNotFoundReason
+	condition.Message = "Cloudflare tunnel " + id + " not found"
+	return condition, nil
+}
+
+// conditionChanged returns whether setting condition would change the given conditions
+func conditionChanged(conditions []metav1.Condition, condition metav1.Condition) bool {
+	current := apimeta.FindStatusCondition(conditions, condition.Type)
+	return current == nil ||
+		current.Status != condition.Status ||
+		current.Reason != condition.Reason ||
+		current.Message != condition.Message ||
+		current.ObservedGeneration != condition.ObservedGeneration
+}
@@ -2,103 +2,426 @@ package controllers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"errors"
-	"math/rand"
-	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
-	"github.com/go-logr/logr"
 	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+// Cloudflare manages tunnels DNS records with a CloudflareClient bound to a single account.
+// The records of each hostname are managed in the zone resolved with ResolveZone.
+// Instances are shared between all tunnels using the same credentials.
 type Cloudflare struct {
-	ctx       context.Context
-	log       logr.Logger
-	accountID string
-	zoneName  string
-	zoneID    string
-	api       *cloudflare.API
+	client CloudflareClient
 }
 
-func (c *Cloudflare) NewTunnelSecretB64() string {
-	length := 32
-	rand.Seed(time.Now().UnixNano())
-	chars := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890!@#$%^&*()-_=+")
-	b := make([]rune, length)
-	for i := range b {
-		b[i] = chars[rand.Intn(len(chars))]
+// cloudflareClientIdleTimeout is the time after which a client which is no longer used is dropped
+const cloudflareClientIdleTimeout = time.Hour
+
+// cloudflareClients caches Cloudflare clients per set of credentials. The tunnels and DNS records they read
+// are cached per account and per zone, and shared between the clients of different credentials.
+type cloudflareClients struct {
+	mu      sync.Mutex
+	clients map[cloudflareClientKey]*cloudflareClient
+	cache   *cloudflareCache
+}
+
+// cloudflareClient is a cached client with the sources of the credentials using it
+type cloudflareClient struct {
+	cf       *Cloudflare
+	sources  map[string]bool
+	lastUsed time.Time
+}
+
+// cloudflareClientKey identifies the client of a set of credentials without holding their API token
+type cloudflareClientKey struct {
+	AccountID string
+	ZoneName  string
+	// TokenHash is the sha256 hash of the API token
+	TokenHash string
+}
+
+func clientKey(creds cloudflareCredentials) cloudflareClientKey {
+	tokenHash := sha256.Sum256([]byte(creds.APIToken))
+	return cloudflareClientKey{AccountID: creds.AccountID, ZoneName: creds.ZoneName, TokenHash: hex.EncodeToString(tokenHash[:])}
+}
+
+// Get returns the cached client for the given credentials, creating it with newClient if needed.
+// The client of the previous credentials of the same source is dropped once no other source uses it,
+// and the clients unused for cloudflareClientIdleTimeout are dropped.
+// The client reuses the tunnels and DNS records it reads for cacheTTL, zero disables caching.
+func (c *cloudflareClients) Get(ctx context.Context, creds cloudflareCredentials, newClient CloudflareClientFactory, cacheTTL time.Duration) (*Cloudflare, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	key := clientKey(creds)
+	for previous, client := range c.clients {
+		if previous == key {
+			continue
+		}
+		delete(client.sources, creds.Source)
+		if len(client.sources) == 0 || now.Sub(client.lastUsed) > cloudflareClientIdleTimeout {
+			delete(c.clients, previous)
+		}
+	}
+	if client, ok := c.clients[key]; ok {
+		client.sources[creds.Source] = true
+		client.lastUsed = now
+		return client.cf, nil
+	}
+	cf, err := newCloudflare(ctx, creds, newClient)
+	if err != nil {
+		return nil, err
+	}
+	if cacheTTL > 0 {
+		if c.cache == nil {
+			c.cache = newCloudflareCache()
+		}
+		cf.client = &cachingClient{client: cf.client, cache: c.cache, ttl: cacheTTL}
+	}
+	if c.clients == nil {
+		c.clients = map[cloudflareClientKey]*cloudflareClient{}
+	}
+	c.clients[key] = &cloudflareClient{cf: cf, sources: map[string]bool{creds.Source: true}, lastUsed: now}
+	return cf, nil
+}
+
+func newCloudflare(ctx context.Context, creds cloudflareCredentials, newClient CloudflareClientFactory) (*Cloudflare, error) {
+	if creds.APIToken == "" {
+		return nil, errors.New("missing cloudflare API token")
+	}
+	if newClient == nil {
+		newClient = NewCloudflareClient
+	}
+	client, err := newClient(creds.APIToken, creds.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cloudflare{
+		client: &instrumentedClient{client: client},
+	}
+	// the zone of the credentials is no longer used to create records, it is still verified to report
+	// credentials which are no longer valid
+	if creds.ZoneName != "" {
+		if _, err := c.client.ZoneIDByName(ctx, creds.ZoneName); err != nil {
+			return nil, fmt.Errorf("failed to resolve zone %s: %w", creds.ZoneName, err)
+		}
 	}
-	return b64.StdEncoding.EncodeToString([]byte(string(b)))
+	return c, nil
 }
 
-func (c *Cloudflare) Api() (*cloudflare.API, error) {
-	if c.api != nil {
-		return c.api, nil
+// tunnelSecretLength is the number of random bytes of a tunnel secret, as generated by `cloudflared tunnel create`
+const tunnelSecretLength = 32
+
+// newTunnelSecretB64 returns a new random tunnel secret, base64 encoded
+func newTunnelSecretB64() (string, error) {
+	b := make([]byte, tunnelSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("failed to generate tunnel secret: " + err.Error())
 	}
-	c.accountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	return b64.StdEncoding.EncodeToString(b), nil
+}
 
-	token := os.Getenv("CLOUDFLARE_API_TOKEN")
-	if token == "" {
-		return nil, errors.New("missing environment variable CLOUDFLARE_API_TOKEN")
+func (c *Cloudflare) Client() CloudflareClient {
+	return c.client
+}
+
+// tunnelDNSRecord returns the CNAME record of hostname expected for the tunnel of t, with the given settings
+func tunnelDNSRecord(t *tunnelv1alpha1.Tunnel, hostname string, dns *tunnelv1alpha1.TunnelIngressDNS) cloudflareapi.DNSRecord {
+	proxied := true
+	ttl := 1
+	comment := ""
+	tags := []string{}
+	if dns != nil {
+		if dns.Proxied != nil {
+			proxied = *dns.Proxied
+		}
+		// cloudflare sets an automatic TTL on proxied records
+		if !proxied && dns.TTL > 0 {
+			ttl = dns.TTL
+		}
+		comment = dns.Comment
+		tags = append(tags, dns.Tags...)
 	}
-	api, err := cloudflare.NewWithAPIToken(token)
+	return cloudflareapi.DNSRecord{
+		DNSRecord: cloudflare.DNSRecord{
+			Type:    "CNAME",
+			Name:    hostname,
+			Content: t.Status.TunnelID + ".cfargotunnel.com",
+			Proxied: &proxied,
+			TTL:     ttl,
+		},
+		Comment: &comment,
+		Tags:    tags,
+	}
+}
+
+// dnsSkipped returns whether the DNS record of the hostname of ingress is managed outside of the operator
+func dnsSkipped(ingress tunnelv1alpha1.TunnelIngress) bool {
+	return ingress.DNS != nil && ingress.DNS.Skip
+}
+
+// dnsRecordSettingsDifferences lists the differences of the proxied flag, TTL, comment and tags of current
+// with the desired record
+func dnsRecordSettingsDifferences(current, desired cloudflareapi.DNSRecord) []string {
+	differences := []string{}
+	prefix := desired.Type + " record " + desired.Name
+	currentProxied := current.Proxied != nil && *current.Proxied
+	desiredProxied := desired.Proxied != nil && *desired.Proxied
+	switch {
+	case desiredProxied && !currentProxied:
+		differences = append(differences, prefix+" is not proxied")
+	case !desiredProxied && currentProxied:
+		differences = append(differences, prefix+" is proxied")
+	}
+	if current.TTL != desired.TTL {
+		differences = append(differences, fmt.Sprintf("%s has TTL %d instead of %d", prefix, current.TTL, desired.TTL))
+	}
+	if current.CommentValue() != desired.CommentValue() {
+		differences = append(differences, fmt.Sprintf("%s has comment %q instead of %q", prefix, current.CommentValue(), desired.CommentValue()))
+	}
+	currentTags := append([]string{}, current.Tags...)
+	desiredTags := append([]string{}, desired.Tags...)
+	sort.Strings(currentTags)
+	sort.Strings(desiredTags)
+	if strings.Join(currentTags, ",") != strings.Join(desiredTags, ",") {
+		differences = append(differences, fmt.Sprintf("%s has tags %v instead of %v", prefix, currentTags, desiredTags))
+	}
+	return differences
+}
+
+// CreateDNSRecord creates record in the zone zoneID unless a record of the same type and name exists,
+// and returns whether it was created
+func (c *Cloudflare) CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (bool, error) {
+	log := ctrllog.FromContext(ctx)
+	tpl := cloudflare.DNSRecord{Name: record.Name, Type: record.Type}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
 	if err != nil {
-		return api, err
+		log.Error(err, "failed to retrieve "+record.Type+" DNS recods from zone "+zoneID)
+		return false, err
+	}
+	if len(records) > 0 {
+		return false, nil
 	}
-	if api.AccountID == "" {
-		api.AccountID = c.accountID
+	log.Info("creating cloudflare " + record.Type + " record for " + record.Name)
+	if _, err := c.client.CreateDNSRecord(ctx, zoneID, record); err != nil {
+		log.Error(err, "failed to create "+record.Type+" record "+record.Name)
+		return false, err
 	}
-	c.api = api
-	c.zoneName = os.Getenv("CLOUDFLARE_ZONE_NAME")
-	c.zoneID, _ = api.ZoneIDByName(c.zoneName)
-	return api, err
+	return true, nil
 }
 
-func (c *Cloudflare) CreateDNSRecord(recordType string, recordName string, content string, proxied bool) error {
-	tpl := cloudflare.DNSRecord{Name: recordName, Type: "CNAME"}
-	records, err := c.api.DNSRecords(context.Background(), c.zoneID, tpl)
+// dnsRecordAction is what EnsureTunnelDNSRecord did with the record of a hostname
+type dnsRecordAction int
+
+const (
+	// dnsRecordUnchanged is a record which already matches
+	dnsRecordUnchanged dnsRecordAction = iota
+	// dnsRecordCreated is a missing record which was created
+	dnsRecordCreated
+	// dnsRecordUpdated is a record targeting the tunnel whose settings were updated in place
+	dnsRecordUpdated
+	// dnsRecordMismatch is a record owned by the Tunnel targeting something else than the tunnel, left unchanged
+	// for the caller to repair
+	dnsRecordMismatch
+	// dnsRecordNotOwned is a record claimed by another owner or not claimed at all, left unchanged
+	dnsRecordNotOwned
+)
+
+// EnsureTunnelDNSRecord creates the CNAME record of a tunnel in the zone zoneID unless a CNAME record of the same
+// name exists, and claims it for owner. An existing record owned by owner and targeting the tunnel is updated in
+// place when its proxied flag, TTL, comment or tags differ from record, other existing records are left unchanged
+// and returned. A record targeting the tunnel without owner, created before the ownership registry, is claimed.
+func (c *Cloudflare) EnsureTunnelDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord, owner dnsOwner) (dnsRecordAction, *cloudflareapi.DNSRecord, error) {
+	log := ctrllog.FromContext(ctx)
+	tpl := cloudflare.DNSRecord{Name: record.Name, Type: record.Type}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
 	if err != nil {
-		c.log.Error(err, "failed to retrieve CNAME DNS recods from zone "+c.zoneName)
-		return err
+		log.Error(err, "failed to retrieve CNAME DNS recods from zone "+zoneID)
+		return dnsRecordUnchanged, nil, err
 	}
 	if len(records) == 0 {
-		c.log.Info("creating cloudflare CNAME record for " + recordName)
-		_, err := c.api.CreateDNSRecord(c.ctx, c.zoneID, cloudflare.DNSRecord{
-			Type:    "CNAME",
-			Name:    recordName,
-			Proxied: &proxied,
-			Content: content,
+		if err := c.ClaimDNSRecord(ctx, zoneID, record.Name, owner); errors.Is(err, errDNSRecordNotOwned) {
+			return dnsRecordNotOwned, nil, nil
+		} else if err != nil {
+			log.Error(err, "failed to claim CNAME record "+record.Name)
+			return dnsRecordUnchanged, nil, err
+		}
+		created, err := c.CreateDNSRecord(ctx, zoneID, record)
+		if !created {
+			return dnsRecordUnchanged, nil, err
+		}
+		return dnsRecordCreated, nil, err
+	}
+	current := records[0]
+	owned, err := c.ownsDNSRecord(ctx, zoneID, record.Name, owner)
+	if err != nil {
+		log.Error(err, "failed to retrieve the owner of CNAME record "+record.Name)
+		return dnsRecordUnchanged, &current, err
+	}
+	if !owned {
+		if !strings.EqualFold(current.Content, record.Content) {
+			return dnsRecordNotOwned, &current, nil
+		}
+		if err := c.ClaimDNSRecord(ctx, zoneID, record.Name, owner); errors.Is(err, errDNSRecordNotOwned) {
+			return dnsRecordNotOwned, &current, nil
+		} else if err != nil {
+			log.Error(err, "failed to claim CNAME record "+record.Name)
+			return dnsRecordUnchanged, &current, err
+		}
+	}
+	if !strings.EqualFold(current.Content, record.Content) {
+		return dnsRecordMismatch, &current, nil
+	}
+	if len(dnsRecordSettingsDifferences(current, record)) == 0 {
+		return dnsRecordUnchanged, &current, nil
+	}
+	log.Info("updating the settings of CNAME record " + record.Name)
+	err = c.client.UpdateDNSRecord(ctx, zoneID, current.ID, cloudflareapi.DNSRecord{
+		DNSRecord: cloudflare.DNSRecord{Proxied: record.Proxied, TTL: record.TTL},
+		Comment:   record.Comment,
+		Tags:      record.Tags,
+	})
+	if err != nil {
+		log.Error(err, "failed to update CNAME record "+record.Name)
+		return dnsRecordUnchanged, &current, err
+	}
+	return dnsRecordUpdated, &current, nil
+}
+
+// tunnelIDFromTarget returns the ID of the tunnel targeted by the content of a CNAME record,
+// empty when the record does not target a tunnel
+func tunnelIDFromTarget(content string) string {
+	content = strings.TrimSuffix(strings.ToLower(content), ".")
+	if !strings.HasSuffix(content, ".cfargotunnel.com") {
+		return ""
+	}
+	return strings.TrimSuffix(content, ".cfargotunnel.com")
+}
+
+// RepointTunnelDNSRecords updates the CNAME records of recordName targeting the old tunnel to target the new one.
+// The records not owned by owner are left unchanged.
+func (c *Cloudflare) RepointTunnelDNSRecords(ctx context.Context, zoneID string, recordName string, oldTunnelID, newTunnelID string, owner dnsOwner) error {
+	log := ctrllog.FromContext(ctx)
+	owned, err := c.ownsDNSRecord(ctx, zoneID, recordName, owner)
+	if err != nil {
+		log.Error(err, "failed to retrieve the owner of CNAME record "+recordName)
+		return err
+	}
+	if !owned {
+		log.Info("not repointing CNAME record " + recordName + ": it is not owned by " + owner.String())
+		return nil
+	}
+	tpl := cloudflare.DNSRecord{Type: "CNAME", Name: recordName, Content: oldTunnelID + ".cfargotunnel.com"}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
+	if err != nil {
+		log.Error(err, "failed to list CNAME records matching "+recordName)
+		return err
+	}
+	for _, record := range records {
+		log.Info("repointing CNAME record " + recordName + " to tunnel " + newTunnelID)
+		err := c.client.UpdateDNSRecord(ctx, zoneID, record.ID, cloudflareapi.DNSRecord{
+			DNSRecord: cloudflare.DNSRecord{Content: newTunnelID + ".cfargotunnel.com"},
 		})
 		if err != nil {
-			c.log.Error(err, "failed to create CNAME record "+recordName)
+			log.Error(err, "failed repointing CNAME record "+recordName)
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Cloudflare) CreateTunnelDNSRecord(recordName string, tunnel *tunnelv1alpha1.Tunnel) error {
-	content := tunnel.Status.TunnelID + ".cfargotunnel.com"
-	return c.CreateDNSRecord("CNAME", recordName, content, true)
+// TunnelDNSRecordDrift compares the CNAME record named after the desired record with it.
+// It returns the differences, and the current record which is nil when it is missing.
+func (c *Cloudflare) TunnelDNSRecordDrift(ctx context.Context, zoneID string, desired cloudflareapi.DNSRecord) (*cloudflareapi.DNSRecord, []string, error) {
+	tpl := cloudflare.DNSRecord{Type: desired.Type, Name: desired.Name}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, []string{"CNAME record " + desired.Name + " is missing"}, nil
+	}
+	record := records[0]
+	differences := []string{}
+	if !strings.EqualFold(record.Content, desired.Content) {
+		differences = append(differences, "CNAME record "+desired.Name+" targets "+record.Content+" instead of "+desired.Content)
+	}
+	differences = append(differences, dnsRecordSettingsDifferences(record, desired)...)
+	return &record, differences, nil
 }
 
-func (c *Cloudflare) DeleteDNSRecords(recordType string, recordName string) error {
-	tpl := cloudflare.DNSRecord{Type: "CNAME", Name: recordName}
-	records, err := c.api.DNSRecords(c.ctx, c.zoneID, tpl)
+// CorrectTunnelDNSRecord reverts the current record to the desired one, creating it when missing.
+// It fails with errDNSRecordNotOwned when the record is not owned by owner.
+func (c *Cloudflare) CorrectTunnelDNSRecord(ctx context.Context, zoneID string, current *cloudflareapi.DNSRecord, desired cloudflareapi.DNSRecord, owner dnsOwner) error {
+	if current == nil {
+		if err := c.ClaimDNSRecord(ctx, zoneID, desired.Name, owner); err != nil {
+			return err
+		}
+		_, err := c.CreateDNSRecord(ctx, zoneID, desired)
+		return err
+	}
+	owned, err := c.ownsDNSRecord(ctx, zoneID, desired.Name, owner)
 	if err != nil {
-		c.log.Error(err, "failed to list CNAME records matching "+recordName)
 		return err
 	}
-	for _, record := range records {
-		c.log.Info("deleting CNAME record " + recordName)
-		if err := c.api.DeleteDNSRecord(c.ctx, c.zoneID, record.ID); err != nil {
-			c.log.Error(err, "failed deleting CNAME record "+recordName)
-			return err
+	if !owned {
+		return notOwnedError(desired.Name)
+	}
+	ctrllog.FromContext(ctx).Info("correcting CNAME record " + desired.Name)
+	return c.client.UpdateDNSRecord(ctx, zoneID, current.ID, cloudflareapi.DNSRecord{
+		DNSRecord: cloudflare.DNSRecord{Content: desired.Content, Proxied: desired.Proxied, TTL: desired.TTL},
+		Comment:   desired.Comment,
+		Tags:      desired.Tags,
+	})
+}
+
+// DeleteTunnelDNSRecords deletes the CNAME records of hostname in the zone zoneID with the TXT record claiming them
+// for owner, and returns how many CNAME records were deleted. It fails with errDNSRecordNotOwned when the records
+// are not owned by owner.
+func (c *Cloudflare) DeleteTunnelDNSRecords(ctx context.Context, zoneID string, hostname string, owner dnsOwner) (int, error) {
+	log := ctrllog.FromContext(ctx)
+	tpl := cloudflare.DNSRecord{Type: "CNAME", Name: hostname}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
+	if err != nil {
+		log.Error(err, "failed to list CNAME records matching "+hostname)
+		return 0, err
+	}
+	owned, err := c.ownsDNSRecord(ctx, zoneID, hostname, owner)
+	if err != nil {
+		log.Error(err, "failed to retrieve the owner of CNAME record "+hostname)
+		return 0, err
+	}
+	if !owned {
+		if len(records) == 0 {
+			return 0, nil
 		}
+		log.Info("not deleting CNAME record " + hostname + ": it is not owned by " + owner.String())
+		return 0, notOwnedError(hostname)
 	}
-	return nil
+	for i, record := range records {
+		log.Info("deleting CNAME record " + hostname)
+		if err := c.client.DeleteDNSRecord(ctx, zoneID, record.ID); err != nil {
+			log.Error(err, "failed deleting CNAME record "+hostname)
+			return i, err
+		}
+	}
+	if err := c.releaseDNSRecord(ctx, zoneID, hostname, owner); err != nil {
+		log.Error(err, "failed to release CNAME record "+hostname)
+		return len(records), err
+	}
+	return len(records), nil
 }
 
 type TunnelConfig struct {
@@ -0,0 +1,261 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// DefaultCloudflareCacheTTL is the default time during which the tunnels and DNS records read from cloudflare are reused
+const DefaultCloudflareCacheTTL = time.Minute
+
+// recordsKey identifies the DNS records of a name and type in a zone
+type recordsKey struct {
+	zoneID     string
+	recordType string
+	name       string
+}
+
+type cachedTunnels struct {
+	tunnels []cloudflare.ArgoTunnel
+	expires time.Time
+}
+
+type cachedRecords struct {
+	records []cloudflareapi.DNSRecord
+	expires time.Time
+}
+
+// cloudflareCache holds the tunnels of accounts and the DNS records of zones read from cloudflare, shared by all
+// the clients of the same accounts and zones. The generations are incremented on each invalidation, so that a read
+// which was in flight during a write is not cached.
+type cloudflareCache struct {
+	mu      sync.Mutex
+	tunnels map[string]cachedTunnels
+	records map[recordsKey]cachedRecords
+
+	accountGenerations map[string]int
+	zoneGenerations    map[string]int
+}
+
+func newCloudflareCache() *cloudflareCache {
+	return &cloudflareCache{
+		tunnels:            map[string]cachedTunnels{},
+		records:            map[recordsKey]cachedRecords{},
+		accountGenerations: map[string]int{},
+		zoneGenerations:    map[string]int{},
+	}
+}
+
+func (c *cloudflareCache) getTunnels(accountID string) ([]cloudflare.ArgoTunnel, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tunnels[accountID]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, c.accountGenerations[accountID], false
+	}
+	return append([]cloudflare.ArgoTunnel{}, cached.tunnels...), 0, true
+}
+
+func (c *cloudflareCache) setTunnels(accountID string, generation int, tunnels []cloudflare.ArgoTunnel, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accountGenerations[accountID] != generation {
+		return
+	}
+	c.tunnels[accountID] = cachedTunnels{
+		tunnels: append([]cloudflare.ArgoTunnel{}, tunnels...),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+func (c *cloudflareCache) invalidateTunnels(accountID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tunnels, accountID)
+	c.accountGenerations[accountID]++
+}
+
+func (c *cloudflareCache) getRecords(key recordsKey) ([]cloudflareapi.DNSRecord, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.records[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, c.zoneGenerations[key.zoneID], false
+	}
+	return append([]cloudflareapi.DNSRecord{}, cached.records...), 0, true
+}
+
+func (c *cloudflareCache) setRecords(key recordsKey, generation int, records []cloudflareapi.DNSRecord, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.zoneGenerations[key.zoneID] != generation {
+		return
+	}
+	c.records[key] = cachedRecords{
+		records: append([]cloudflareapi.DNSRecord{}, records...),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// invalidateZone drops all the cached records of a zone: the updated and deleted records are only known by ID
+func (c *cloudflareCache) invalidateZone(zoneID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.records {
+		if key.zoneID == zoneID {
+			delete(c.records, key)
+		}
+	}
+	c.zoneGenerations[zoneID]++
+}
+
+// cachingClient is a CloudflareClient reusing the tunnels and DNS records it read for ttl,
+// the cache is invalidated by the writes made through the client
+type cachingClient struct {
+	client CloudflareClient
+	cache  *cloudflareCache
+	ttl    time.Duration
+
+	zonesMu     sync.Mutex
+	zones       []cloudflare.Zone
+	zonesExpire time.Time
+}
+
+func (c *cachingClient) AccountID() string {
+	return c.client.AccountID()
+}
+
+func (c *cachingClient) ArgoTunnels(ctx context.Context) ([]cloudflare.ArgoTunnel, error) {
+	accountID := c.client.AccountID()
+	tunnels, generation, ok := c.cache.getTunnels(accountID)
+	if ok {
+		return tunnels, nil
+	}
+	tunnels, err := c.client.ArgoTunnels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.setTunnels(accountID, generation, tunnels, c.ttl)
+	return tunnels, nil
+}
+
+// ArgoTunnel is never cached, it confirms what the cached tunnels report
+func (c *cachingClient) ArgoTunnel(ctx context.Context, tunnelID string) (cloudflare.ArgoTunnel, error) {
+	return c.client.ArgoTunnel(ctx, tunnelID)
+}
+
+func (c *cachingClient) CreateArgoTunnel(ctx context.Context, name, secret string) (cloudflare.ArgoTunnel, error) {
+	defer c.cache.invalidateTunnels(c.client.AccountID())
+	return c.client.CreateArgoTunnel(ctx, name, secret)
+}
+
+func (c *cachingClient) DeleteArgoTunnel(ctx context.Context, tunnelID string) error {
+	defer c.cache.invalidateTunnels(c.client.AccountID())
+	return c.client.DeleteArgoTunnel(ctx, tunnelID)
+}
+
+func (c *cachingClient) UpdateTunnelSecret(ctx context.Context, tunnelID, secret string) error {
+	defer c.cache.invalidateTunnels(c.client.AccountID())
+	return c.client.UpdateTunnelSecret(ctx, tunnelID, secret)
+}
+
+func (c *cachingClient) TunnelConnections(ctx context.Context, tunnelID string) ([]tunnelv1alpha1.TunnelConnection, error) {
+	return c.client.TunnelConnections(ctx, tunnelID)
+}
+
+func (c *cachingClient) TunnelConfiguration(ctx context.Context, tunnelID string) (cloudflareapi.TunnelConfiguration, error) {
+	return c.client.TunnelConfiguration(ctx, tunnelID)
+}
+
+func (c *cachingClient) UpdateTunnelConfiguration(ctx context.Context, tunnelID string, config cloudflareapi.TunnelConfiguration) error {
+	return c.client.UpdateTunnelConfiguration(ctx, tunnelID, config)
+}
+
+func (c *cachingClient) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	return c.client.ZoneIDByName(ctx, zoneName)
+}
+
+// ListZones caches the zones in the client rather than in the shared cache: they depend on the API token
+func (c *cachingClient) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	if c.zones != nil && time.Now().Before(c.zonesExpire) {
+		return append([]cloudflare.Zone{}, c.zones...), nil
+	}
+	zones, err := c.client.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.zones = append([]cloudflare.Zone{}, zones...)
+	c.zonesExpire = time.Now().Add(c.ttl)
+	return zones, nil
+}
+
+// DNSRecords caches the records per name and type, filters on other fields are applied to the cached records
+func (c *cachingClient) DNSRecords(ctx context.Context, zoneID string, filter cloudflare.DNSRecord) ([]cloudflareapi.DNSRecord, error) {
+	if filter.Name == "" || filter.Type == "" || filter.Proxied != nil || filter.ID != "" {
+		return c.client.DNSRecords(ctx, zoneID, filter)
+	}
+	key := recordsKey{zoneID: zoneID, recordType: filter.Type, name: strings.ToLower(filter.Name)}
+	records, generation, ok := c.cache.getRecords(key)
+	if !ok {
+		var err error
+		records, err = c.client.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{Type: filter.Type, Name: filter.Name})
+		if err != nil {
+			return nil, err
+		}
+		c.cache.setRecords(key, generation, records, c.ttl)
+	}
+	if filter.Content == "" {
+		return records, nil
+	}
+	matching := []cloudflareapi.DNSRecord{}
+	for _, r := range records {
+		if strings.EqualFold(r.Content, filter.Content) {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
+
+func (c *cachingClient) CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error) {
+	defer c.cache.invalidateZone(zoneID)
+	return c.client.CreateDNSRecord(ctx, zoneID, record)
+}
+
+func (c *cachingClient) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, record cloudflareapi.DNSRecord) error {
+	defer c.cache.invalidateZone(zoneID)
+	return c.client.UpdateDNSRecord(ctx, zoneID, recordID, record)
+}
+
+func (c *cachingClient) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	defer c.cache.invalidateZone(zoneID)
+	return c.client.DeleteDNSRecord(ctx, zoneID, recordID)
+}
+
+func (c *cachingClient) VerifyAPIToken(ctx context.Context) (cloudflare.APITokenVerifyBody, error) {
+	return c.client.VerifyAPIToken(ctx)
+}
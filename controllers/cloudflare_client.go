@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// CloudflareClient is the subset of the cloudflare API used to manage tunnels and their DNS records.
+// A client is bound to a single cloudflare account. The calls are canceled with their ctx.
+type CloudflareClient interface {
+	// AccountID returns the ID of the account the client is bound to
+	AccountID() string
+
+	ArgoTunnels(ctx context.Context) ([]cloudflare.ArgoTunnel, error)
+	// ArgoTunnel gets a tunnel by ID. A deleted tunnel is returned with its deletion time.
+	ArgoTunnel(ctx context.Context, tunnelID string) (cloudflare.ArgoTunnel, error)
+	CreateArgoTunnel(ctx context.Context, name, secret string) (cloudflare.ArgoTunnel, error)
+	DeleteArgoTunnel(ctx context.Context, tunnelID string) error
+	// UpdateTunnelSecret replaces the secret of a tunnel, disconnecting the connectors using the previous one
+	UpdateTunnelSecret(ctx context.Context, tunnelID, secret string) error
+	// TunnelConnections lists the connections of the connectors of a tunnel to the cloudflare edge
+	TunnelConnections(ctx context.Context, tunnelID string) ([]tunnelv1alpha1.TunnelConnection, error)
+	// TunnelConfiguration returns the remote configuration of a tunnel, empty when it is not remotely managed
+	TunnelConfiguration(ctx context.Context, tunnelID string) (cloudflareapi.TunnelConfiguration, error)
+	// UpdateTunnelConfiguration replaces the remote configuration of a tunnel, making it remotely managed
+	UpdateTunnelConfiguration(ctx context.Context, tunnelID string, config cloudflareapi.TunnelConfiguration) error
+
+	ZoneIDByName(ctx context.Context, zoneName string) (string, error)
+	// ListZones lists the DNS zones accessible with the API token of the client
+	ListZones(ctx context.Context) ([]cloudflare.Zone, error)
+	// DNSRecords lists the records of a zone matching the name, type and content of filter
+	DNSRecords(ctx context.Context, zoneID string, filter cloudflare.DNSRecord) ([]cloudflareapi.DNSRecord, error)
+	CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error)
+	// UpdateDNSRecord updates the fields of a record which are set in record
+	UpdateDNSRecord(ctx context.Context, zoneID, recordID string, record cloudflareapi.DNSRecord) error
+	DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error
+
+	VerifyAPIToken(ctx context.Context) (cloudflare.APITokenVerifyBody, error)
+}
+
+// CloudflareClientFactory creates a CloudflareClient for the given API token and account
+type CloudflareClientFactory func(apiToken, accountID string) (CloudflareClient, error)
+
+// isCloudflareNotFound returns whether err is a cloudflare API error reporting a missing object
+func isCloudflareNotFound(err error) bool {
+	var apiErr *cloudflare.APIRequestError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// apiClient implements CloudflareClient with the cloudflare-go library
+type apiClient struct {
+	api *cloudflare.API
+	// httpClient sends the requests to the endpoints not supported by cloudflare-go
+	httpClient *http.Client
+}
+
+// NewCloudflareClient is the CloudflareClientFactory talking to the cloudflare API
+func NewCloudflareClient(apiToken, accountID string) (CloudflareClient, error) {
+	return NewCloudflareClientFactory(nil)(apiToken, accountID)
+}
+
+// NewCloudflareClientFactory returns a CloudflareClientFactory sending its requests with httpClient,
+// http.DefaultClient when nil, and passing additional options to cloudflare-go, like cloudflare.BaseURL to talk to
+// a local API stand-in
+func NewCloudflareClientFactory(httpClient *http.Client, opts ...cloudflare.Option) CloudflareClientFactory {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return func(apiToken, accountID string) (CloudflareClient, error) {
+		opts := append([]cloudflare.Option{cloudflare.UsingAccount(accountID), cloudflare.HTTPClient(httpClient)}, opts...)
+		api, err := cloudflare.NewWithAPIToken(apiToken, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &apiClient{api: api, httpClient: httpClient}, nil
+	}
+}
+
+// raw sends a request to an endpoint of the cloudflare API and returns the result of its response.
+// It replaces cloudflare.API.Raw, which does not propagate ctx.
+func (c *apiClient) raw(ctx context.Context, method, endpoint string, data interface{}) (json.RawMessage, error) {
+	var body io.Reader
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.api.BaseURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.api.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	if c.api.UserAgent != "" {
+		req.Header.Set("User-Agent", c.api.UserAgent)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := cloudflare.RawResponse{}
+	decodeErr := json.Unmarshal(respBody, &response)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &cloudflare.APIRequestError{StatusCode: resp.StatusCode, Errors: response.Errors}
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return response.Result, nil
+}
+
+func (c *apiClient) AccountID() string {
+	return c.api.AccountID
+}
+
+func (c *apiClient) ArgoTunnels(ctx context.Context) ([]cloudflare.ArgoTunnel, error) {
+	return c.api.ArgoTunnels(ctx, c.api.AccountID)
+}
+
+// ArgoTunnel uses the cfd_tunnel endpoint directly, cloudflare-go gets tunnels from the legacy tunnels endpoint
+func (c *apiClient) ArgoTunnel(ctx context.Context, tunnelID string) (cloudflare.ArgoTunnel, error) {
+	tunnel := cloudflare.ArgoTunnel{}
+	raw, err := c.raw(ctx, http.MethodGet, "/accounts/"+c.api.AccountID+"/cfd_tunnel/"+tunnelID, nil)
+	if err != nil {
+		return tunnel, err
+	}
+	err = json.Unmarshal(raw, &tunnel)
+	return tunnel, err
+}
+
+func (c *apiClient) CreateArgoTunnel(ctx context.Context, name, secret string) (cloudflare.ArgoTunnel, error) {
+	return c.api.CreateArgoTunnel(ctx, c.api.AccountID, name, secret)
+}
+
+func (c *apiClient) DeleteArgoTunnel(ctx context.Context, tunnelID string) error {
+	return c.api.DeleteArgoTunnel(ctx, c.api.AccountID, tunnelID)
+}
+
+// UpdateTunnelSecret is not supported by cloudflare-go, it uses the cfd_tunnel endpoint directly
+func (c *apiClient) UpdateTunnelSecret(ctx context.Context, tunnelID, secret string) error {
+	_, err := c.raw(ctx, http.MethodPatch, "/accounts/"+c.api.AccountID+"/cfd_tunnel/"+tunnelID,
+		map[string]string{"tunnel_secret": secret})
+	return err
+}
+
+// tunnelConnector is a connector listed by the cfd_tunnel connections endpoint
+type tunnelConnector struct {
+	ID          string `json:"id"`
+	Version     string `json:"version"`
+	Connections []struct {
+		ID                 string     `json:"id"`
+		ColoName           string     `json:"colo_name"`
+		ClientID           string     `json:"client_id"`
+		ClientVersion      string     `json:"client_version"`
+		OriginIP           string     `json:"origin_ip"`
+		OpenedAt           *time.Time `json:"opened_at"`
+		IsPendingReconnect bool       `json:"is_pending_reconnect"`
+	} `json:"conns"`
+}
+
+// TunnelConnections is not supported by cloudflare-go, it uses the cfd_tunnel endpoint directly
+func (c *apiClient) TunnelConnections(ctx context.Context, tunnelID string) ([]tunnelv1alpha1.TunnelConnection, error) {
+	raw, err := c.raw(ctx, http.MethodGet, "/accounts/"+c.api.AccountID+"/cfd_tunnel/"+tunnelID+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	connectors := []tunnelConnector{}
+	if err := json.Unmarshal(raw, &connectors); err != nil {
+		return nil, err
+	}
+	connections := []tunnelv1alpha1.TunnelConnection{}
+	for _, connector := range connectors {
+		for _, conn := range connector.Connections {
+			connection := tunnelv1alpha1.TunnelConnection{
+				ID:                 conn.ID,
+				ConnectorID:        connector.ID,
+				ColoName:           conn.ColoName,
+				ClientVersion:      conn.ClientVersion,
+				OriginIP:           conn.OriginIP,
+				IsPendingReconnect: conn.IsPendingReconnect,
+			}
+			if connection.ClientVersion == "" {
+				connection.ClientVersion = connector.Version
+			}
+			if conn.OpenedAt != nil {
+				openedAt := metav1.NewTime(*conn.OpenedAt)
+				connection.OpenedAt = &openedAt
+			}
+			connections = append(connections, connection)
+		}
+	}
+	return connections, nil
+}
+
+// TunnelConfiguration is not supported by cloudflare-go, it uses the cfd_tunnel endpoint directly
+func (c *apiClient) TunnelConfiguration(ctx context.Context, tunnelID string) (cloudflareapi.TunnelConfiguration, error) {
+	result := struct {
+		Config *cloudflareapi.TunnelConfiguration `json:"config"`
+	}{}
+	raw, err := c.raw(ctx, http.MethodGet, "/accounts/"+c.api.AccountID+"/cfd_tunnel/"+tunnelID+"/configurations", nil)
+	if err != nil {
+		return cloudflareapi.TunnelConfiguration{}, err
+	}
+	if err := json.Unmarshal(raw, &result); err != nil || result.Config == nil {
+		return cloudflareapi.TunnelConfiguration{}, err
+	}
+	return *result.Config, nil
+}
+
+// UpdateTunnelConfiguration is not supported by cloudflare-go, it uses the cfd_tunnel endpoint directly
+func (c *apiClient) UpdateTunnelConfiguration(ctx context.Context, tunnelID string, config cloudflareapi.TunnelConfiguration) error {
+	_, err := c.raw(ctx, http.MethodPut, "/accounts/"+c.api.AccountID+"/cfd_tunnel/"+tunnelID+"/configurations",
+		map[string]interface{}{"config": config})
+	return err
+}
+
+// ZoneIDByName lists the zones itself: cloudflare.API.ZoneIDByName does not propagate ctx
+func (c *apiClient) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	zones, err := c.api.ListZonesContext(ctx, cloudflare.WithZoneFilters(zoneName, c.api.AccountID, ""))
+	if err != nil {
+		return "", err
+	}
+	switch len(zones.Result) {
+	case 0:
+		return "", errors.New("zone could not be found")
+	case 1:
+		return zones.Result[0].ID, nil
+	default:
+		return "", errors.New("ambiguous zone name " + zoneName)
+	}
+}
+
+func (c *apiClient) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
+	return c.api.ListZones(ctx)
+}
+
+// dnsRecordsPerPage is the number of DNS records listed per request
+const dnsRecordsPerPage = 100
+
+// DNSRecords uses the dns_records endpoint directly: cloudflare-go does not return the comment and tags of records
+func (c *apiClient) DNSRecords(ctx context.Context, zoneID string, filter cloudflare.DNSRecord) ([]cloudflareapi.DNSRecord, error) {
+	query := url.Values{}
+	if filter.Name != "" {
+		query.Set("name", filter.Name)
+	}
+	if filter.Type != "" {
+		query.Set("type", filter.Type)
+	}
+	if filter.Content != "" {
+		query.Set("content", filter.Content)
+	}
+	query.Set("per_page", strconv.Itoa(dnsRecordsPerPage))
+	records := []cloudflareapi.DNSRecord{}
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		raw, err := c.raw(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		pageRecords := []cloudflareapi.DNSRecord{}
+		if err := json.Unmarshal(raw, &pageRecords); err != nil {
+			return nil, err
+		}
+		records = append(records, pageRecords...)
+		if len(pageRecords) < dnsRecordsPerPage {
+			return records, nil
+		}
+	}
+}
+
+// CreateDNSRecord uses the dns_records endpoint directly to set the comment and tags of the record
+func (c *apiClient) CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error) {
+	raw, err := c.raw(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", record)
+	if err != nil {
+		return cloudflareapi.DNSRecord{}, err
+	}
+	created := cloudflareapi.DNSRecord{}
+	if err := json.Unmarshal(raw, &created); err != nil {
+		return cloudflareapi.DNSRecord{}, err
+	}
+	return created, nil
+}
+
+// UpdateDNSRecord uses the dns_records endpoint directly to update the comment and tags of the record
+func (c *apiClient) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, record cloudflareapi.DNSRecord) error {
+	_, err := c.raw(ctx, http.MethodPatch, "/zones/"+zoneID+"/dns_records/"+recordID, record)
+	return err
+}
+
+func (c *apiClient) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	return c.api.DeleteDNSRecord(ctx, zoneID, recordID)
+}
+
+func (c *apiClient) VerifyAPIToken(ctx context.Context) (cloudflare.APITokenVerifyBody, error) {
+	return c.api.VerifyAPIToken(ctx)
+}
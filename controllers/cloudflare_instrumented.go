@@ -0,0 +1,149 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// cloudflareAPIError is a failed call to the cloudflare API. It allows reporting the failures on the tunnels,
+// whatever the operation that led to them.
+type cloudflareAPIError struct {
+	Operation string
+	Err       error
+}
+
+func (e *cloudflareAPIError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *cloudflareAPIError) Unwrap() error {
+	return e.Err
+}
+
+// instrumentedClient is a CloudflareClient recording metrics about its calls and returning its errors as
+// cloudflareAPIErrors
+type instrumentedClient struct {
+	client CloudflareClient
+}
+
+// observe records the metrics of a call to operation started at start, and wraps the error it returned in *err
+func observe(operation string, start time.Time, err *error) {
+	cloudflareAPIRequests.WithLabelValues(operation).Inc()
+	cloudflareAPIRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err == nil {
+		return
+	}
+	statusCode := "none"
+	var requestErr *cloudflare.APIRequestError
+	var limitedErr *RateLimitedError
+	if errors.As(*err, &requestErr) {
+		statusCode = strconv.Itoa(requestErr.StatusCode)
+	} else if errors.As(*err, &limitedErr) {
+		statusCode = strconv.Itoa(http.StatusTooManyRequests)
+	}
+	cloudflareAPIErrors.WithLabelValues(operation, statusCode).Inc()
+	*err = &cloudflareAPIError{Operation: operation, Err: *err}
+}
+
+func (c *instrumentedClient) AccountID() string {
+	return c.client.AccountID()
+}
+
+func (c *instrumentedClient) ArgoTunnels(ctx context.Context) (tunnels []cloudflare.ArgoTunnel, err error) {
+	defer observe("ArgoTunnels", time.Now(), &err)
+	return c.client.ArgoTunnels(ctx)
+}
+
+func (c *instrumentedClient) ArgoTunnel(ctx context.Context, tunnelID string) (tunnel cloudflare.ArgoTunnel, err error) {
+	defer observe("ArgoTunnel", time.Now(), &err)
+	return c.client.ArgoTunnel(ctx, tunnelID)
+}
+
+func (c *instrumentedClient) CreateArgoTunnel(ctx context.Context, name, secret string) (tunnel cloudflare.ArgoTunnel, err error) {
+	defer observe("CreateArgoTunnel", time.Now(), &err)
+	return c.client.CreateArgoTunnel(ctx, name, secret)
+}
+
+func (c *instrumentedClient) DeleteArgoTunnel(ctx context.Context, tunnelID string) (err error) {
+	defer observe("DeleteArgoTunnel", time.Now(), &err)
+	return c.client.DeleteArgoTunnel(ctx, tunnelID)
+}
+
+func (c *instrumentedClient) UpdateTunnelSecret(ctx context.Context, tunnelID, secret string) (err error) {
+	defer observe("UpdateTunnelSecret", time.Now(), &err)
+	return c.client.UpdateTunnelSecret(ctx, tunnelID, secret)
+}
+
+func (c *instrumentedClient) TunnelConfiguration(ctx context.Context, tunnelID string) (config cloudflareapi.TunnelConfiguration, err error) {
+	defer observe("TunnelConfiguration", time.Now(), &err)
+	return c.client.TunnelConfiguration(ctx, tunnelID)
+}
+
+func (c *instrumentedClient) UpdateTunnelConfiguration(ctx context.Context, tunnelID string, config cloudflareapi.TunnelConfiguration) (err error) {
+	defer observe("UpdateTunnelConfiguration", time.Now(), &err)
+	return c.client.UpdateTunnelConfiguration(ctx, tunnelID, config)
+}
+
+func (c *instrumentedClient) TunnelConnections(ctx context.Context, tunnelID string) (connections []tunnelv1alpha1.TunnelConnection, err error) {
+	defer observe("TunnelConnections", time.Now(), &err)
+	return c.client.TunnelConnections(ctx, tunnelID)
+}
+
+func (c *instrumentedClient) ZoneIDByName(ctx context.Context, zoneName string) (id string, err error) {
+	defer observe("ZoneIDByName", time.Now(), &err)
+	return c.client.ZoneIDByName(ctx, zoneName)
+}
+
+func (c *instrumentedClient) ListZones(ctx context.Context) (zones []cloudflare.Zone, err error) {
+	defer observe("ListZones", time.Now(), &err)
+	return c.client.ListZones(ctx)
+}
+
+func (c *instrumentedClient) DNSRecords(ctx context.Context, zoneID string, filter cloudflare.DNSRecord) (records []cloudflareapi.DNSRecord, err error) {
+	defer observe("DNSRecords", time.Now(), &err)
+	return c.client.DNSRecords(ctx, zoneID, filter)
+}
+
+func (c *instrumentedClient) CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (created cloudflareapi.DNSRecord, err error) {
+	defer observe("CreateDNSRecord", time.Now(), &err)
+	return c.client.CreateDNSRecord(ctx, zoneID, record)
+}
+
+func (c *instrumentedClient) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, record cloudflareapi.DNSRecord) (err error) {
+	defer observe("UpdateDNSRecord", time.Now(), &err)
+	return c.client.UpdateDNSRecord(ctx, zoneID, recordID, record)
+}
+
+func (c *instrumentedClient) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) (err error) {
+	defer observe("DeleteDNSRecord", time.Now(), &err)
+	return c.client.DeleteDNSRecord(ctx, zoneID, recordID)
+}
+
+func (c *instrumentedClient) VerifyAPIToken(ctx context.Context) (body cloudflare.APITokenVerifyBody, err error) {
+	defer observe("VerifyAPIToken", time.Now(), &err)
+	return c.client.VerifyAPIToken(ctx)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// accountVerifyInterval is the period at which API tokens are verified again,
+// as they can expire or be revoked at any time
+const accountVerifyInterval = time.Hour
+
+// apiTokenSecretIndexKey indexes accounts by the secret holding their API token
+const apiTokenSecretIndexKey = ".spec.apiTokenSecretRef"
+
+// CloudflareAccountReconciler reconciles a CloudflareAccount object
+type CloudflareAccountReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// NewCloudflareClient creates the clients used to reach cloudflare, defaults to NewCloudflareClient
+	NewCloudflareClient CloudflareClientFactory
+}
+
+//+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=cloudflareaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=cloudflareaccounts/status,verbs=get;update;patch
+
+// Reconcile verifies the API token of a CloudflareAccount and reports it in its Ready condition
+func (r *CloudflareAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+
+	account := &tunnelv1alpha1.CloudflareAccount{}
+	if err := r.Get(ctx, req.NamespacedName, account); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Failed to get CloudflareAccount")
+		return ctrl.Result{}, err
+	}
+
+	condition, err := verifyAccount(ctx, r.Client, r.NewCloudflareClient, account.Namespace, account.Spec)
+	if retryAfter, limited := rateLimitRetryAfter(err); limited {
+		log.Info("cloudflare API rate limit reached", "retryAfter", retryAfter)
+		return ctrl.Result{RequeueAfter: retryAfter}, nil
+	}
+	if err != nil {
+		log.Error(err, "failed to verify cloudflare account")
+		return ctrl.Result{}, err
+	}
+	condition.ObservedGeneration = account.Generation
+	apimeta.SetStatusCondition(&account.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, account); err != nil {
+		log.Error(err, "Failed to update CloudflareAccount status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: accountVerifyInterval}, nil
+}
+
+// verifyAccount checks the API token and zones of an account, returning the resulting Ready condition.
+// Errors are only returned for transient failures which should be retried.
+func verifyAccount(ctx context.Context, c client.Reader, newClient CloudflareClientFactory, secretNamespace string, spec tunnelv1alpha1.CloudflareAccountSpec) (metav1.Condition, error) {
+	token, err := readSecretKey(ctx, c, secretNamespace, spec.APITokenSecretRef)
+	if err != nil {
+		var credsErr *credentialsError
+		if !errors.As(err, &credsErr) {
+			return metav1.Condition{}, err
+		}
+		return accountNotReady(credsErr.Reason, credsErr.Message), nil
+	}
+
+	if newClient == nil {
+		newClient = NewCloudflareClient
+	}
+	api, err := newClient(token, spec.AccountID)
+	if err != nil {
+		return accountNotReady(tunnelv1alpha1.CloudflareAccountConditionTokenInvalidReason, err.Error()), nil
+	}
+	api = &instrumentedClient{client: api}
+	verified, err := api.VerifyAPIToken(ctx)
+	if err != nil {
+		if _, limited := rateLimitRetryAfter(err); limited {
+			return metav1.Condition{}, err
+		}
+		var apiErr *cloudflare.APIRequestError
+		if errors.As(err, &apiErr) && apiErr.ClientError() {
+			return accountNotReady(tunnelv1alpha1.CloudflareAccountConditionTokenInvalidReason, err.Error()), nil
+		}
+		return metav1.Condition{}, err
+	}
+	if verified.Status != "active" {
+		return accountNotReady(tunnelv1alpha1.CloudflareAccountConditionTokenInvalidReason, "API token is "+verified.Status), nil
+	}
+	for _, zone := range spec.Zones {
+		if _, err := api.ZoneIDByName(ctx, zone); err != nil {
+			if _, limited := rateLimitRetryAfter(err); limited {
+				return metav1.Condition{}, err
+			}
+			return accountNotReady(tunnelv1alpha1.CloudflareAccountConditionZoneNotFoundReason, "zone "+zone+": "+err.Error()), nil
+		}
+	}
+	return metav1.Condition{
+		Type:    tunnelv1alpha1.CloudflareAccountConditionReadyType,
+		Status:  metav1.ConditionTrue,
+		Reason:  tunnelv1alpha1.CloudflareAccountConditionVerifiedSuccessReason,
+		Message: "API token verified",
+	}, nil
+}
+
+func accountNotReady(reason, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:    tunnelv1alpha1.CloudflareAccountConditionReadyType,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+// accountsForSecret maps a secret to the CloudflareAccounts of its namespace holding their token in it
+func (r *CloudflareAccountReconciler) accountsForSecret(secret client.Object) []reconcile.Request {
+	accounts := &tunnelv1alpha1.CloudflareAccountList{}
+	err := r.List(context.Background(), accounts,
+		client.InNamespace(secret.GetNamespace()),
+		client.MatchingFields{apiTokenSecretIndexKey: secret.GetName()})
+	if err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, a := range accounts.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: a.Namespace, Name: a.Name},
+		})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CloudflareAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &tunnelv1alpha1.CloudflareAccount{}, apiTokenSecretIndexKey,
+		func(o client.Object) []string {
+			return []string{o.(*tunnelv1alpha1.CloudflareAccount).Spec.APITokenSecretRef.Name}
+		})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&tunnelv1alpha1.CloudflareAccount{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.accountsForSecret)).
+		Complete(r)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// accountReadyCondition fetches the current Ready condition of a CloudflareAccount or ClusterCloudflareAccount
+func accountReadyCondition(ctx context.Context, key types.NamespacedName, account client.Object) func() *metav1.Condition {
+	return func() *metav1.Condition {
+		if err := k8sClient.Get(ctx, key, account); err != nil {
+			return nil
+		}
+		var conditions []metav1.Condition
+		switch a := account.(type) {
+		case *tunnelv1alpha1.CloudflareAccount:
+			conditions = a.Status.Conditions
+		case *tunnelv1alpha1.ClusterCloudflareAccount:
+			conditions = a.Status.Conditions
+		}
+		return apimeta.FindStatusCondition(conditions, tunnelv1alpha1.CloudflareAccountConditionReadyType)
+	}
+}
+
+// newTestAccount returns a CloudflareAccount in the default namespace reading its API token from secretName
+func newTestAccount(name, secretName string, allowedNamespaces ...string) *tunnelv1alpha1.CloudflareAccount {
+	return &tunnelv1alpha1.CloudflareAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: tunnelv1alpha1.CloudflareAccountSpec{
+			APITokenSecretRef: tunnelv1alpha1.SecretKeyReference{Name: secretName},
+			AccountID:         testAccountID,
+			AllowedNamespaces: allowedNamespaces,
+		},
+	}
+}
+
+// createTokenSecret creates a secret in the default namespace holding an API token under key
+func createTokenSecret(ctx context.Context, name, key string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		StringData: map[string]string{key: "account-token"},
+	}
+	Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+	return secret
+}
+
+var _ = Describe("CloudflareAccount controller", func() {
+	ctx := context.Background()
+
+	It("reports the verification of its API token in its Ready condition", func() {
+		account := newTestAccount("verified", "verified-token")
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		key := types.NamespacedName{Namespace: account.Namespace, Name: account.Name}
+		ready := accountReadyCondition(ctx, key, &tunnelv1alpha1.CloudflareAccount{})
+
+		By("reporting a missing secret")
+		Eventually(ready, timeout, interval).Should(PointTo(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionSecretNotFoundReason),
+		)))
+
+		By("reporting a secret missing the token key")
+		secret := createTokenSecret(ctx, "verified-token", "OTHER_KEY")
+		Eventually(ready, timeout, interval).Should(
+			HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionSecretInvalidReason))
+
+		By("verifying the token once the secret holds it")
+		secret.StringData = map[string]string{accountSecretAPITokenKey: "account-token"}
+		Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+		Eventually(ready, timeout, interval).Should(PointTo(And(
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionVerifiedSuccessReason),
+		)))
+
+		By("reporting a token which is no longer active")
+		fakeCloudflare.SetTokenStatus("disabled")
+		defer fakeCloudflare.SetTokenStatus("active")
+		Expect(k8sClient.Get(ctx, key, account)).To(Succeed())
+		account.Spec.Zones = []string{testZoneName}
+		Expect(k8sClient.Update(ctx, account)).To(Succeed())
+		Eventually(ready, timeout, interval).Should(PointTo(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionTokenInvalidReason),
+			HaveField("Message", ContainSubstring("disabled")),
+		)))
+	})
+
+	It("reports the zones of the account which cannot be found", func() {
+		createTokenSecret(ctx, "zones-token", accountSecretAPITokenKey)
+		account := newTestAccount("zones", "zones-token")
+		account.Spec.Zones = []string{testZoneName, "missing.example.org"}
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		key := types.NamespacedName{Namespace: account.Namespace, Name: account.Name}
+
+		Eventually(accountReadyCondition(ctx, key, &tunnelv1alpha1.CloudflareAccount{}), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionZoneNotFoundReason),
+				HaveField("Message", ContainSubstring("missing.example.org")),
+			)))
+	})
+
+	It("verifies the API token of a ClusterCloudflareAccount from the namespace of its secret", func() {
+		createTokenSecret(ctx, "cluster-token", accountSecretAPITokenKey)
+		account := &tunnelv1alpha1.ClusterCloudflareAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-verified"},
+			Spec: tunnelv1alpha1.CloudflareAccountSpec{
+				APITokenSecretRef: tunnelv1alpha1.SecretKeyReference{Name: "cluster-token", Namespace: "default"},
+				AccountID:         testAccountID,
+			},
+		}
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		key := types.NamespacedName{Name: account.Name}
+
+		Eventually(accountReadyCondition(ctx, key, &tunnelv1alpha1.ClusterCloudflareAccount{}), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionTrue),
+				HaveField("Reason", tunnelv1alpha1.CloudflareAccountConditionVerifiedSuccessReason),
+			)))
+	})
+
+	It("lets Tunnels use a Ready account allowing their namespace", func() {
+		createTokenSecret(ctx, "shared-token", accountSecretAPITokenKey)
+		shared := newTestAccount("shared", "shared-token", "tenant-allowed")
+		Expect(k8sClient.Create(ctx, shared)).To(Succeed())
+		for _, name := range []string{"tenant-allowed", "tenant-denied"} {
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})).To(Succeed())
+		}
+
+		By("creating the tunnel of an allowed namespace")
+		allowed := newTestTunnel("account-allowed")
+		allowed.Namespace = "tenant-allowed"
+		allowed.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Name: "shared", Namespace: "default"}
+		allowed = createdTunnel(ctx, allowed)
+		Expect(allowed.Status.AccountID).To(Equal(testAccountID))
+		Expect(apimeta.FindStatusCondition(allowed.Status.Conditions, tunnelv1alpha1.TunnelConditionCredentialsType)).
+			To(PointTo(HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsSuccessReason)))
+
+		By("refusing the tunnel of another namespace")
+		denied := newTestTunnel("account-denied")
+		denied.Namespace = "tenant-denied"
+		denied.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Name: "shared", Namespace: "default"}
+		Expect(k8sClient.Create(ctx, denied)).To(Succeed())
+		deniedKey := types.NamespacedName{Namespace: denied.Namespace, Name: denied.Name}
+		Eventually(tunnelCondition(ctx, deniedKey, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsAccountNotAllowedReason),
+			)))
+		Expect(getTunnel(ctx, deniedKey)()).To(HaveField("Status.TunnelID", BeEmpty()))
+
+		By("reporting a missing account")
+		missing := newTestTunnel("account-missing")
+		missing.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Kind: tunnelv1alpha1.ClusterCloudflareAccountKind, Name: "missing"}
+		Expect(k8sClient.Create(ctx, missing)).To(Succeed())
+		Eventually(tunnelCondition(ctx, types.NamespacedName{Namespace: "default", Name: missing.Name}, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsAccountNotFoundReason)))
+	})
+
+	It("only lets Tunnels use a ClusterCloudflareAccount listing their namespace", func() {
+		createTokenSecret(ctx, "cluster-shared-token", accountSecretAPITokenKey)
+		account := &tunnelv1alpha1.ClusterCloudflareAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-shared"},
+			Spec: tunnelv1alpha1.CloudflareAccountSpec{
+				APITokenSecretRef: tunnelv1alpha1.SecretKeyReference{Name: "cluster-shared-token", Namespace: "default"},
+				AccountID:         testAccountID,
+			},
+		}
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		tunnel := newTestTunnel("cluster-account")
+		tunnel.Spec.AccountRef = &tunnelv1alpha1.AccountReference{
+			Kind: tunnelv1alpha1.ClusterCloudflareAccountKind,
+			Name: account.Name,
+		}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		By("refusing the tunnel while the account lists no namespace")
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsAccountNotAllowedReason)))
+		Expect(getTunnel(ctx, key)()).To(HaveField("Status.TunnelID", BeEmpty()))
+
+		By("creating the tunnel once the account allows all namespaces")
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: account.Name}, account)).To(Succeed())
+		account.Spec.AllowedNamespaces = []string{tunnelv1alpha1.AllNamespaces}
+		Expect(k8sClient.Update(ctx, account)).To(Succeed())
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", Not(BeEmpty())))
+	})
+
+	It("waits for the account of a Tunnel to be Ready", func() {
+		account := newTestAccount("pending", "pending-token")
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		tunnel := newTestTunnel("account-pending")
+		tunnel.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Name: "pending"}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsAccountNotReadyReason),
+			)))
+
+		By("creating the tunnel once the account is verified")
+		createTokenSecret(ctx, "pending-token", accountSecretAPITokenKey)
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", Not(BeEmpty())))
+	})
+})
@@ -0,0 +1,62 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudflareapi holds the cloudflare API objects which are not supported by cloudflare-go yet,
+// shared by the operator and its fake cloudflare API
+package cloudflareapi
+
+import (
+	"encoding/json"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// DNSRecord is a cloudflare DNS record with its comment and tags
+type DNSRecord struct {
+	cloudflare.DNSRecord
+
+	// Comment is the comment of the record. Updates leave it unchanged when nil, and remove it when empty.
+	Comment *string `json:"comment,omitempty"`
+	// Tags are the name:value tags of the record. Updates leave them unchanged when nil, and remove them when empty.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// MarshalJSON sends the comment and tags which are set, even when empty
+func (r DNSRecord) MarshalJSON() ([]byte, error) {
+	raw, err := json.Marshal(r.DNSRecord)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if r.Comment != nil {
+		fields["comment"] = *r.Comment
+	}
+	if r.Tags != nil {
+		fields["tags"] = r.Tags
+	}
+	return json.Marshal(fields)
+}
+
+// CommentValue returns the comment of the record, empty when it has none
+func (r DNSRecord) CommentValue() string {
+	if r.Comment == nil {
+		return ""
+	}
+	return *r.Comment
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflareapi
+
+// TunnelConfiguration is the configuration of a remotely managed tunnel, pulled by cloudflared from the edge
+type TunnelConfiguration struct {
+	Ingress []TunnelIngressRule `json:"ingress"`
+}
+
+// TunnelIngressRule is an ingress rule of a remotely managed tunnel
+type TunnelIngressRule struct {
+	Hostname string `json:"hostname,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Service  string `json:"service"`
+	// OriginRequest holds the origin settings of the rule, with durations in seconds
+	OriginRequest map[string]interface{} `json:"originRequest,omitempty"`
+}
@@ -0,0 +1,607 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudflarefake provides an in-memory cloudflare account implementing
+// the controllers.CloudflareClient interface, to test the controllers offline.
+package cloudflarefake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// Names of the recorded methods, to be used for error injection and call inspection
+const (
+	MethodArgoTunnels               = "ArgoTunnels"
+	MethodArgoTunnel                = "ArgoTunnel"
+	MethodCreateArgoTunnel          = "CreateArgoTunnel"
+	MethodDeleteArgoTunnel          = "DeleteArgoTunnel"
+	MethodUpdateTunnelSecret        = "UpdateTunnelSecret"
+	MethodTunnelConnections         = "TunnelConnections"
+	MethodTunnelConfiguration       = "TunnelConfiguration"
+	MethodUpdateTunnelConfiguration = "UpdateTunnelConfiguration"
+	MethodZoneIDByName              = "ZoneIDByName"
+	MethodListZones                 = "ListZones"
+	MethodDNSRecords                = "DNSRecords"
+	MethodCreateDNSRecord           = "CreateDNSRecord"
+	MethodUpdateDNSRecord           = "UpdateDNSRecord"
+	MethodDeleteDNSRecord           = "DeleteDNSRecord"
+	MethodVerifyAPIToken            = "VerifyAPIToken"
+)
+
+// Call records a call made to the fake
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Cloudflare is an in-memory cloudflare account holding tunnels and DNS zones.
+// It is safe for concurrent use.
+type Cloudflare struct {
+	mu sync.Mutex
+
+	accountID   string
+	tokenStatus string
+	lastID      int
+
+	tunnels []cloudflare.ArgoTunnel
+	// unlisted holds the IDs of the tunnels missing from the tunnel listings
+	unlisted    map[string]bool
+	connections map[string][]tunnelv1alpha1.TunnelConnection
+	// configurations holds the remote configuration of the remotely managed tunnels
+	configurations map[string]cloudflareapi.TunnelConfiguration
+	zones          map[string]*zone
+
+	calls      []Call
+	errors     map[string]error
+	nextErrors map[string][]error
+}
+
+type zone struct {
+	id      string
+	name    string
+	records []cloudflareapi.DNSRecord
+}
+
+// New returns an empty fake cloudflare account
+func New(accountID string) *Cloudflare {
+	return &Cloudflare{
+		accountID:      accountID,
+		tokenStatus:    "active",
+		unlisted:       map[string]bool{},
+		connections:    map[string][]tunnelv1alpha1.TunnelConnection{},
+		configurations: map[string]cloudflareapi.TunnelConfiguration{},
+		zones:          map[string]*zone{},
+		errors:         map[string]error{},
+		nextErrors:     map[string][]error{},
+	}
+}
+
+func (f *Cloudflare) newID() string {
+	f.lastID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", f.lastID)
+}
+
+// record records a call and returns the error to inject for it, if any. It must be called with the lock held.
+func (f *Cloudflare) record(method string, args ...interface{}) error {
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	if errs := f.nextErrors[method]; len(errs) > 0 {
+		f.nextErrors[method] = errs[1:]
+		return errs[0]
+	}
+	return f.errors[method]
+}
+
+// SetError makes all the following calls to method fail with err, until cleared with a nil error
+func (f *Cloudflare) SetError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, method)
+		return
+	}
+	f.errors[method] = err
+}
+
+// FailNext makes the next call to method fail with err. Errors queue up when called several times.
+func (f *Cloudflare) FailNext(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextErrors[method] = append(f.nextErrors[method], err)
+}
+
+// ClearErrors removes all the injected errors
+func (f *Cloudflare) ClearErrors() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = map[string]error{}
+	f.nextErrors = map[string][]error{}
+}
+
+// Calls returns the calls made so far, optionally restricted to the given methods
+func (f *Cloudflare) Calls(methods ...string) []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := []Call{}
+	for _, c := range f.calls {
+		if len(methods) == 0 || contains(methods, c.Method) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// CallCount returns the number of calls made so far to method
+func (f *Cloudflare) CallCount(method string) int {
+	return len(f.Calls(method))
+}
+
+// ResetCalls forgets the calls recorded so far
+func (f *Cloudflare) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// SetTokenStatus sets the status reported when verifying the API token, "active" by default
+func (f *Cloudflare) SetTokenStatus(status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokenStatus = status
+}
+
+// AddZone adds a DNS zone to the account and returns its ID
+func (f *Cloudflare) AddZone(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	z := &zone{id: f.newID(), name: name}
+	f.zones[z.id] = z
+	return z.id
+}
+
+// AddTunnel creates a tunnel out of band, as done by `cloudflared tunnel create`
+func (f *Cloudflare) AddTunnel(name, secret string) cloudflare.ArgoTunnel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addTunnel(name, secret)
+}
+
+func (f *Cloudflare) addTunnel(name, secret string) cloudflare.ArgoTunnel {
+	now := time.Now()
+	t := cloudflare.ArgoTunnel{ID: f.newID(), Name: name, Secret: secret, CreatedAt: &now}
+	f.tunnels = append(f.tunnels, t)
+	return t
+}
+
+// RemoveTunnel deletes a tunnel out of band, as done from the cloudflare dashboard
+func (f *Cloudflare) RemoveTunnel(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_ = f.deleteTunnel(id)
+}
+
+func (f *Cloudflare) deleteTunnel(id string) error {
+	for i := range f.tunnels {
+		if f.tunnels[i].ID == id && f.tunnels[i].DeletedAt == nil {
+			now := time.Now()
+			f.tunnels[i].DeletedAt = &now
+			delete(f.connections, id)
+			return nil
+		}
+	}
+	return notFound("tunnel " + id + " not found")
+}
+
+// SetListed includes or omits a tunnel from the tunnel listings, like a truncated or stale listing does
+func (f *Cloudflare) SetListed(tunnelID string, listed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if listed {
+		delete(f.unlisted, tunnelID)
+	} else {
+		f.unlisted[tunnelID] = true
+	}
+}
+
+// SetConnections replaces the connections of a tunnel to the edge, as done by starting or stopping cloudflared
+func (f *Cloudflare) SetConnections(tunnelID string, connections ...tunnelv1alpha1.TunnelConnection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connections[tunnelID] = append([]tunnelv1alpha1.TunnelConnection{}, connections...)
+}
+
+// Tunnels returns the tunnels of the account which are not deleted
+func (f *Cloudflare) Tunnels() []cloudflare.ArgoTunnel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tunnels := []cloudflare.ArgoTunnel{}
+	for _, t := range f.tunnels {
+		if t.DeletedAt == nil {
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels
+}
+
+// Records returns the DNS records of a zone, sorted by name
+func (f *Cloudflare) Records(zoneName string) []cloudflareapi.DNSRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	records := []cloudflareapi.DNSRecord{}
+	for _, z := range f.zones {
+		if z.name == zoneName {
+			records = append(records, z.records...)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+// Zones returns the DNS zones of the account, sorted by name
+func (f *Cloudflare) Zones() []cloudflare.Zone {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.zoneList()
+}
+
+func (f *Cloudflare) zoneList() []cloudflare.Zone {
+	zones := []cloudflare.Zone{}
+	for _, z := range f.zones {
+		zone := cloudflare.Zone{ID: z.id, Name: z.name, Status: "active", Type: "full"}
+		zone.Account.ID = f.accountID
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Name < zones[j].Name })
+	return zones
+}
+
+// AddRecord creates a DNS record out of band and returns it
+func (f *Cloudflare) AddRecord(zoneName string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, z := range f.zones {
+		if z.name == zoneName {
+			return f.createRecord(id, record)
+		}
+	}
+	return cloudflareapi.DNSRecord{}, notFound("zone " + zoneName + " not found")
+}
+
+// AccountID implements CloudflareClient
+func (f *Cloudflare) AccountID() string {
+	return f.accountID
+}
+
+// ArgoTunnels implements CloudflareClient. Like cloudflare, deleted tunnels are listed with their deletion time.
+func (f *Cloudflare) ArgoTunnels(ctx context.Context) ([]cloudflare.ArgoTunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodArgoTunnels); err != nil {
+		return nil, err
+	}
+	tunnels := []cloudflare.ArgoTunnel{}
+	for _, t := range f.tunnels {
+		if !f.unlisted[t.ID] {
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels, nil
+}
+
+// ArgoTunnel implements CloudflareClient
+func (f *Cloudflare) ArgoTunnel(ctx context.Context, tunnelID string) (cloudflare.ArgoTunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodArgoTunnel, tunnelID); err != nil {
+		return cloudflare.ArgoTunnel{}, err
+	}
+	for _, t := range f.tunnels {
+		if t.ID == tunnelID {
+			return t, nil
+		}
+	}
+	return cloudflare.ArgoTunnel{}, notFound("tunnel " + tunnelID + " not found")
+}
+
+// CreateArgoTunnel implements CloudflareClient
+func (f *Cloudflare) CreateArgoTunnel(ctx context.Context, name, secret string) (cloudflare.ArgoTunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodCreateArgoTunnel, name, secret); err != nil {
+		return cloudflare.ArgoTunnel{}, err
+	}
+	for _, t := range f.tunnels {
+		if t.Name == name && t.DeletedAt == nil {
+			return cloudflare.ArgoTunnel{}, apiError(http.StatusConflict, 1013, "You already have a named tunnel with this name.")
+		}
+	}
+	return f.addTunnel(name, secret), nil
+}
+
+// DeleteArgoTunnel implements CloudflareClient
+func (f *Cloudflare) DeleteArgoTunnel(ctx context.Context, tunnelID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDeleteArgoTunnel, tunnelID); err != nil {
+		return err
+	}
+	return f.deleteTunnel(tunnelID)
+}
+
+// UpdateTunnelSecret implements CloudflareClient
+func (f *Cloudflare) UpdateTunnelSecret(ctx context.Context, tunnelID, secret string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodUpdateTunnelSecret, tunnelID, secret); err != nil {
+		return err
+	}
+	for i := range f.tunnels {
+		if f.tunnels[i].ID == tunnelID && f.tunnels[i].DeletedAt == nil {
+			f.tunnels[i].Secret = secret
+			return nil
+		}
+	}
+	return notFound("tunnel " + tunnelID + " not found")
+}
+
+// Configuration returns the remote configuration of a tunnel, false if it is not remotely managed
+func (f *Cloudflare) Configuration(tunnelID string) (cloudflareapi.TunnelConfiguration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config, ok := f.configurations[tunnelID]
+	return config, ok
+}
+
+// TunnelConfiguration implements CloudflareClient
+func (f *Cloudflare) TunnelConfiguration(ctx context.Context, tunnelID string) (cloudflareapi.TunnelConfiguration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodTunnelConfiguration, tunnelID); err != nil {
+		return cloudflareapi.TunnelConfiguration{}, err
+	}
+	for _, t := range f.tunnels {
+		if t.ID == tunnelID && t.DeletedAt == nil {
+			return f.configurations[tunnelID], nil
+		}
+	}
+	return cloudflareapi.TunnelConfiguration{}, notFound("tunnel " + tunnelID + " not found")
+}
+
+// UpdateTunnelConfiguration implements CloudflareClient
+func (f *Cloudflare) UpdateTunnelConfiguration(ctx context.Context, tunnelID string, config cloudflareapi.TunnelConfiguration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodUpdateTunnelConfiguration, tunnelID, config); err != nil {
+		return err
+	}
+	for _, t := range f.tunnels {
+		if t.ID == tunnelID && t.DeletedAt == nil {
+			f.configurations[tunnelID] = config
+			return nil
+		}
+	}
+	return notFound("tunnel " + tunnelID + " not found")
+}
+
+// TunnelConnections implements CloudflareClient
+func (f *Cloudflare) TunnelConnections(ctx context.Context, tunnelID string) ([]tunnelv1alpha1.TunnelConnection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodTunnelConnections, tunnelID); err != nil {
+		return nil, err
+	}
+	for _, t := range f.tunnels {
+		if t.ID == tunnelID && t.DeletedAt == nil {
+			return append([]tunnelv1alpha1.TunnelConnection{}, f.connections[tunnelID]...), nil
+		}
+	}
+	return nil, notFound("tunnel " + tunnelID + " not found")
+}
+
+// ZoneIDByName implements CloudflareClient
+func (f *Cloudflare) ZoneIDByName(ctx context.Context, zoneName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodZoneIDByName, zoneName); err != nil {
+		return "", err
+	}
+	for id, z := range f.zones {
+		if z.name == zoneName {
+			return id, nil
+		}
+	}
+	return "", errors.New("zone could not be found")
+}
+
+// ListZones implements CloudflareClient
+func (f *Cloudflare) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodListZones); err != nil {
+		return nil, err
+	}
+	return f.zoneList(), nil
+}
+
+// DNSRecords implements CloudflareClient, filtering records on the name, type and content of filter
+func (f *Cloudflare) DNSRecords(ctx context.Context, zoneID string, filter cloudflare.DNSRecord) ([]cloudflareapi.DNSRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDNSRecords, zoneID, filter); err != nil {
+		return nil, err
+	}
+	z, ok := f.zones[zoneID]
+	if !ok {
+		return nil, notFound("zone " + zoneID + " not found")
+	}
+	records := []cloudflareapi.DNSRecord{}
+	for _, r := range z.records {
+		if (filter.Name == "" || strings.EqualFold(filter.Name, r.Name)) &&
+			(filter.Type == "" || filter.Type == r.Type) &&
+			(filter.Content == "" || filter.Content == r.Content) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// CreateDNSRecord implements CloudflareClient
+func (f *Cloudflare) CreateDNSRecord(ctx context.Context, zoneID string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodCreateDNSRecord, zoneID, record); err != nil {
+		return cloudflareapi.DNSRecord{}, err
+	}
+	return f.createRecord(zoneID, record)
+}
+
+func (f *Cloudflare) createRecord(zoneID string, record cloudflareapi.DNSRecord) (cloudflareapi.DNSRecord, error) {
+	z, ok := f.zones[zoneID]
+	if !ok {
+		return cloudflareapi.DNSRecord{}, notFound("zone " + zoneID + " not found")
+	}
+	for _, r := range z.records {
+		if strings.EqualFold(r.Name, record.Name) && (r.Type == "CNAME" || record.Type == "CNAME") {
+			return cloudflareapi.DNSRecord{}, apiError(http.StatusBadRequest, 81053, "An A, AAAA, or CNAME record with that host already exists.")
+		}
+	}
+	if record.Proxied != nil {
+		proxied := *record.Proxied
+		record.Proxied = &proxied
+	}
+	if record.Comment != nil {
+		comment := *record.Comment
+		record.Comment = &comment
+	}
+	record.Tags = append([]string{}, record.Tags...)
+	now := time.Now()
+	record.ID = f.newID()
+	record.ZoneID = z.id
+	record.ZoneName = z.name
+	record.CreatedOn = now
+	record.ModifiedOn = now
+	if record.TTL == 0 {
+		record.TTL = 1
+	}
+	z.records = append(z.records, record)
+	return record, nil
+}
+
+// UpdateDNSRecord implements CloudflareClient, only the set fields of record are updated
+func (f *Cloudflare) UpdateDNSRecord(ctx context.Context, zoneID, recordID string, record cloudflareapi.DNSRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodUpdateDNSRecord, zoneID, recordID, record); err != nil {
+		return err
+	}
+	z, ok := f.zones[zoneID]
+	if !ok {
+		return notFound("zone " + zoneID + " not found")
+	}
+	for i := range z.records {
+		r := &z.records[i]
+		if r.ID != recordID {
+			continue
+		}
+		if record.Name != "" {
+			r.Name = record.Name
+		}
+		if record.Type != "" {
+			r.Type = record.Type
+		}
+		if record.Content != "" {
+			r.Content = record.Content
+		}
+		if record.Proxied != nil {
+			proxied := *record.Proxied
+			r.Proxied = &proxied
+		}
+		if record.TTL != 0 {
+			r.TTL = record.TTL
+		}
+		if record.Comment != nil {
+			comment := *record.Comment
+			r.Comment = &comment
+		}
+		if record.Tags != nil {
+			r.Tags = append([]string{}, record.Tags...)
+		}
+		r.ModifiedOn = time.Now()
+		return nil
+	}
+	return notFound("record " + recordID + " not found")
+}
+
+// DeleteDNSRecord implements CloudflareClient
+func (f *Cloudflare) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDeleteDNSRecord, zoneID, recordID); err != nil {
+		return err
+	}
+	z, ok := f.zones[zoneID]
+	if !ok {
+		return notFound("zone " + zoneID + " not found")
+	}
+	for i, r := range z.records {
+		if r.ID == recordID {
+			z.records = append(z.records[:i], z.records[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("record " + recordID + " not found")
+}
+
+// VerifyAPIToken implements CloudflareClient
+func (f *Cloudflare) VerifyAPIToken(ctx context.Context) (cloudflare.APITokenVerifyBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodVerifyAPIToken); err != nil {
+		return cloudflare.APITokenVerifyBody{}, err
+	}
+	return cloudflare.APITokenVerifyBody{ID: "fake-token", Status: f.tokenStatus}, nil
+}
+
+func apiError(status, code int, message string) error {
+	return &cloudflare.APIRequestError{
+		StatusCode: status,
+		Errors:     []cloudflare.ResponseInfo{{Code: code, Message: message}},
+	}
+}
+
+func notFound(message string) error {
+	return apiError(http.StatusNotFound, 1003, message)
+}
+
+func contains(slice []string, str string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,687 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflarefake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// APIPath is the path under which the handler serves the cloudflare v4 API, like api.cloudflare.com
+const APIPath = "/client/v4"
+
+// Default page sizes of the paginated endpoints, as documented by cloudflare
+const (
+	defaultZonesPerPage      = 20
+	defaultDNSRecordsPerPage = 100
+	defaultTunnelsPerPage    = 20
+	maxPerPage               = 5000
+)
+
+// Handler serves the subset of the cloudflare v4 REST API used by the operator, backed by fake accounts:
+// token verification, zone lookup, DNS records of a zone and tunnels of an account.
+// Calls are made through the account methods, so errors injected with SetError and FailNext
+// are answered with the matching HTTP status and error envelope.
+type Handler struct {
+	mu sync.Mutex
+
+	accounts map[string]*Cloudflare
+	tokens   map[string]bool
+
+	rateLimitNext  int
+	rateLimit      int
+	rateWindow     time.Duration
+	windowStart    time.Time
+	windowRequests int
+	retryAfter     time.Duration
+}
+
+// NewHandler returns a Handler serving the given accounts
+func NewHandler(accounts ...*Cloudflare) *Handler {
+	h := &Handler{
+		accounts: map[string]*Cloudflare{},
+		tokens:   map[string]bool{},
+	}
+	for _, a := range accounts {
+		h.AddAccount(a)
+	}
+	return h
+}
+
+// AddAccount serves an additional account
+func (h *Handler) AddAccount(account *Cloudflare) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.accounts[account.AccountID()] = account
+}
+
+// AddToken restricts the accepted API tokens. All bearer tokens are accepted until a first token is added.
+func (h *Handler) AddToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens[token] = true
+}
+
+// RateLimitNext answers the next n requests with a 429 status and the given Retry-After delay
+func (h *Handler) RateLimitNext(n int, retryAfter time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rateLimitNext = n
+	h.retryAfter = retryAfter
+}
+
+// SetRateLimit limits the number of requests accepted per window, like the cloudflare global
+// rate limit of 1200 requests per 5 minutes. A zero limit disables rate limiting.
+func (h *Handler) SetRateLimit(limit int, window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rateLimit = limit
+	h.rateWindow = window
+	h.windowStart = time.Now()
+	h.windowRequests = 0
+}
+
+// rateLimited returns the delay after which the request can be retried, if it is rate limited
+func (h *Handler) rateLimited() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rateLimitNext > 0 {
+		h.rateLimitNext--
+		return h.retryAfter, true
+	}
+	if h.rateLimit <= 0 {
+		return 0, false
+	}
+	now := time.Now()
+	if now.Sub(h.windowStart) >= h.rateWindow {
+		h.windowStart = now
+		h.windowRequests = 0
+	}
+	h.windowRequests++
+	if h.windowRequests > h.rateLimit {
+		return h.windowStart.Add(h.rateWindow).Sub(now), true
+	}
+	return 0, false
+}
+
+func (h *Handler) account(id string) *Cloudflare {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.accounts[id]
+}
+
+// zoneAccount returns the account owning the zone with the given ID
+func (h *Handler) zoneAccount(zoneID string) *Cloudflare {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, a := range h.accounts {
+		for _, z := range a.Zones() {
+			if z.ID == zoneID {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) authorized(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return apiError(http.StatusBadRequest, 9106, "Missing X-Auth-Key, X-Auth-Email or Authorization headers")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" {
+		return apiError(http.StatusBadRequest, 6111, "Invalid format for Authorization header")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.tokens) > 0 && !h.tokens[token] {
+		return apiError(http.StatusForbidden, 9109, "Invalid access token")
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, APIPath+"/") {
+		writeError(w, noRoute())
+		return
+	}
+	if delay, limited := h.rateLimited(); limited {
+		seconds := int((delay + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, apiError(http.StatusTooManyRequests, 10000,
+			"Rate limited. Please wait and consider throttling your request speed"))
+		return
+	}
+	if err := h.authorized(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPath), "/"), "/")
+	switch {
+	case len(path) == 3 && path[0] == "user" && path[1] == "tokens" && path[2] == "verify":
+		h.serveTokenVerify(w, r)
+	case len(path) == 1 && path[0] == "zones":
+		h.serveZones(w, r)
+	case len(path) >= 3 && path[0] == "zones" && path[2] == "dns_records":
+		h.serveDNSRecords(w, r, path[1], path[3:])
+	case len(path) >= 3 && path[0] == "accounts" && (path[2] == "tunnels" || path[2] == "cfd_tunnel"):
+		h.serveTunnels(w, r, path[1], path[3:])
+	default:
+		writeError(w, noRoute())
+	}
+}
+
+func (h *Handler) serveTokenVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, methodNotAllowed())
+		return
+	}
+	// tokens are not bound to an account in the fake, the first account answers
+	h.mu.Lock()
+	var account *Cloudflare
+	for _, a := range h.accounts {
+		if account == nil || a.AccountID() < account.AccountID() {
+			account = a
+		}
+	}
+	h.mu.Unlock()
+	if account == nil {
+		writeError(w, apiError(http.StatusUnauthorized, 1000, "Invalid API Token"))
+		return
+	}
+	body, err := account.VerifyAPIToken(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, http.StatusOK, body, nil)
+}
+
+func (h *Handler) serveZones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, methodNotAllowed())
+		return
+	}
+	query := r.URL.Query()
+	h.mu.Lock()
+	accounts := []*Cloudflare{}
+	for _, a := range h.accounts {
+		if id := query.Get("account.id"); id == "" || id == a.AccountID() {
+			accounts = append(accounts, a)
+		}
+	}
+	h.mu.Unlock()
+	// keep a stable order across pages
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].AccountID() < accounts[j].AccountID() })
+
+	zones := []cloudflare.Zone{}
+	for _, a := range accounts {
+		for _, z := range a.Zones() {
+			if name := query.Get("name"); name == "" || strings.EqualFold(name, z.Name) {
+				zones = append(zones, z)
+			}
+		}
+	}
+	page, info, err := paginate(query, len(zones), defaultZonesPerPage)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, http.StatusOK, zones[page.start:page.end], info)
+}
+
+func (h *Handler) serveDNSRecords(w http.ResponseWriter, r *http.Request, zoneID string, path []string) {
+	account := h.zoneAccount(zoneID)
+	if account == nil {
+		writeError(w, apiError(http.StatusNotFound, 7003,
+			"Could not route to "+r.URL.Path+", perhaps your object identifier is invalid?"))
+		return
+	}
+	ctx := r.Context()
+
+	if len(path) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			records, err := account.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{
+				Name:    query.Get("name"),
+				Type:    query.Get("type"),
+				Content: query.Get("content"),
+			})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			page, info, err := paginate(query, len(records), defaultDNSRecordsPerPage)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, http.StatusOK, records[page.start:page.end], info)
+		case http.MethodPost:
+			record := cloudflareapi.DNSRecord{}
+			if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+				writeError(w, invalidBody(err))
+				return
+			}
+			if record.Type == "" || record.Name == "" || record.Content == "" {
+				writeError(w, apiError(http.StatusBadRequest, 9000, "DNS record type, name and content are required"))
+				return
+			}
+			created, err := account.CreateDNSRecord(ctx, zoneID, record)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, http.StatusOK, created, nil)
+		default:
+			writeError(w, methodNotAllowed())
+		}
+		return
+	}
+	if len(path) != 1 {
+		writeError(w, noRoute())
+		return
+	}
+
+	recordID := path[0]
+	switch r.Method {
+	case http.MethodGet:
+		record, err := findRecord(ctx, account, zoneID, recordID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, record, nil)
+	case http.MethodPatch, http.MethodPut:
+		record := cloudflareapi.DNSRecord{}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			writeError(w, invalidBody(err))
+			return
+		}
+		if err := account.UpdateDNSRecord(ctx, zoneID, recordID, record); err != nil {
+			writeError(w, err)
+			return
+		}
+		updated, err := findRecord(ctx, account, zoneID, recordID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, updated, nil)
+	case http.MethodDelete:
+		if err := account.DeleteDNSRecord(ctx, zoneID, recordID); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, map[string]string{"id": recordID}, nil)
+	default:
+		writeError(w, methodNotAllowed())
+	}
+}
+
+func findRecord(ctx context.Context, account *Cloudflare, zoneID, recordID string) (cloudflareapi.DNSRecord, error) {
+	records, err := account.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{})
+	if err != nil {
+		return cloudflareapi.DNSRecord{}, err
+	}
+	for _, record := range records {
+		if record.ID == recordID {
+			return record, nil
+		}
+	}
+	return cloudflareapi.DNSRecord{}, apiError(http.StatusNotFound, 81044, "Record does not exist.")
+}
+
+func (h *Handler) serveTunnels(w http.ResponseWriter, r *http.Request, accountID string, path []string) {
+	account := h.account(accountID)
+	if account == nil {
+		writeError(w, apiError(http.StatusForbidden, 9109, "Unauthorized to access requested resource"))
+		return
+	}
+	ctx := r.Context()
+
+	if len(path) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			tunnels, err := account.ArgoTunnels(ctx)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			query := r.URL.Query()
+			filtered := []cloudflare.ArgoTunnel{}
+			for _, t := range tunnels {
+				if name := query.Get("name"); name != "" && name != t.Name {
+					continue
+				}
+				if deleted := query.Get("is_deleted"); deleted != "" && deleted != strconv.FormatBool(t.DeletedAt != nil) {
+					continue
+				}
+				t.Secret = ""
+				filtered = append(filtered, t)
+			}
+			// the legacy tunnels endpoint used by cloudflare-go is not paginated, unless asked to
+			if query.Get("page") == "" && query.Get("per_page") == "" {
+				writeResult(w, http.StatusOK, filtered, nil)
+				return
+			}
+			page, info, err := paginate(query, len(filtered), defaultTunnelsPerPage)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, http.StatusOK, filtered[page.start:page.end], info)
+		case http.MethodPost:
+			body := cloudflare.ArgoTunnel{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeError(w, invalidBody(err))
+				return
+			}
+			if body.Name == "" {
+				writeError(w, apiError(http.StatusBadRequest, 1003, "tunnel name is required"))
+				return
+			}
+			if body.Secret == "" {
+				writeError(w, apiError(http.StatusBadRequest, 1003, "tunnel_secret is required"))
+				return
+			}
+			tunnel, err := account.CreateArgoTunnel(ctx, body.Name, body.Secret)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			tunnel.Secret = ""
+			writeResult(w, http.StatusOK, tunnel, nil)
+		default:
+			writeError(w, methodNotAllowed())
+		}
+		return
+	}
+	if len(path) == 2 && path[1] == "configurations" {
+		if r.Method == http.MethodGet {
+			config, err := account.TunnelConfiguration(ctx, path[0])
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeResult(w, http.StatusOK, map[string]interface{}{"tunnel_id": path[0], "config": config}, nil)
+			return
+		}
+		if r.Method != http.MethodPut {
+			writeError(w, methodNotAllowed())
+			return
+		}
+		body := struct {
+			Config cloudflareapi.TunnelConfiguration `json:"config"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, invalidBody(err))
+			return
+		}
+		if err := account.UpdateTunnelConfiguration(ctx, path[0], body.Config); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, map[string]interface{}{"tunnel_id": path[0], "config": body.Config}, nil)
+		return
+	}
+	if len(path) == 2 && path[1] == "connections" {
+		if r.Method != http.MethodGet {
+			writeError(w, methodNotAllowed())
+			return
+		}
+		h.serveTunnelConnections(w, r, account, path[0])
+		return
+	}
+	if len(path) != 1 {
+		writeError(w, noRoute())
+		return
+	}
+
+	tunnelID := path[0]
+	switch r.Method {
+	case http.MethodGet:
+		tunnel, err := findTunnel(ctx, account, tunnelID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, tunnel, nil)
+	case http.MethodPatch:
+		body := cloudflare.ArgoTunnel{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, invalidBody(err))
+			return
+		}
+		if body.Secret != "" {
+			if err := account.UpdateTunnelSecret(ctx, tunnelID, body.Secret); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		tunnel, err := findTunnel(ctx, account, tunnelID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, tunnel, nil)
+	case http.MethodDelete:
+		if err := account.DeleteArgoTunnel(ctx, tunnelID); err != nil {
+			writeError(w, err)
+			return
+		}
+		tunnel, err := findTunnel(ctx, account, tunnelID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusOK, tunnel, nil)
+	default:
+		writeError(w, methodNotAllowed())
+	}
+}
+
+// connector is a cloudflared instance as listed by the cfd_tunnel connections endpoint
+type connector struct {
+	ID          string                `json:"id"`
+	Version     string                `json:"version,omitempty"`
+	Connections []connectorConnection `json:"conns"`
+}
+
+type connectorConnection struct {
+	ID                 string     `json:"id"`
+	ColoName           string     `json:"colo_name,omitempty"`
+	ClientID           string     `json:"client_id"`
+	ClientVersion      string     `json:"client_version,omitempty"`
+	OriginIP           string     `json:"origin_ip,omitempty"`
+	OpenedAt           *time.Time `json:"opened_at,omitempty"`
+	IsPendingReconnect bool       `json:"is_pending_reconnect"`
+}
+
+// serveTunnelConnections lists the connections of a tunnel grouped by connector, like cloudflare
+func (h *Handler) serveTunnelConnections(w http.ResponseWriter, r *http.Request, account *Cloudflare, tunnelID string) {
+	connections, err := account.TunnelConnections(r.Context(), tunnelID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	connectors := []connector{}
+	index := map[string]int{}
+	for _, c := range connections {
+		i, ok := index[c.ConnectorID]
+		if !ok {
+			i = len(connectors)
+			index[c.ConnectorID] = i
+			connectors = append(connectors, connector{ID: c.ConnectorID, Version: c.ClientVersion})
+		}
+		conn := connectorConnection{
+			ID:                 c.ID,
+			ColoName:           c.ColoName,
+			ClientID:           c.ConnectorID,
+			ClientVersion:      c.ClientVersion,
+			OriginIP:           c.OriginIP,
+			IsPendingReconnect: c.IsPendingReconnect,
+		}
+		if c.OpenedAt != nil {
+			conn.OpenedAt = &c.OpenedAt.Time
+		}
+		connectors[i].Connections = append(connectors[i].Connections, conn)
+	}
+	writeResult(w, http.StatusOK, connectors, nil)
+}
+
+func findTunnel(ctx context.Context, account *Cloudflare, tunnelID string) (cloudflare.ArgoTunnel, error) {
+	tunnel, err := account.ArgoTunnel(ctx, tunnelID)
+	tunnel.Secret = ""
+	return tunnel, err
+}
+
+// pageBounds are the bounds of a page in the full list of results
+type pageBounds struct {
+	start, end int
+}
+
+// paginate computes the requested page of a list of total items, and its result_info
+func paginate(query map[string][]string, total, defaultPerPage int) (pageBounds, *cloudflare.ResultInfo, error) {
+	page, perPage := 1, defaultPerPage
+	if v := firstValue(query, "page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return pageBounds{}, nil, apiError(http.StatusBadRequest, 1004, "page must be a positive integer")
+		}
+		page = n
+	}
+	if v := firstValue(query, "per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			return pageBounds{}, nil, apiError(http.StatusBadRequest, 1004, "per_page must be between 1 and "+strconv.Itoa(maxPerPage))
+		}
+		perPage = n
+	}
+	totalPages := (total + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return pageBounds{start: start, end: end}, &cloudflare.ResultInfo{
+		Page:       page,
+		PerPage:    perPage,
+		TotalPages: totalPages,
+		Count:      end - start,
+		Total:      total,
+	}, nil
+}
+
+func firstValue(query map[string][]string, key string) string {
+	if values := query[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// envelope is the body of all the cloudflare API responses
+type envelope struct {
+	Success    bool                      `json:"success"`
+	Errors     []cloudflare.ResponseInfo `json:"errors"`
+	Messages   []cloudflare.ResponseInfo `json:"messages"`
+	Result     interface{}               `json:"result"`
+	ResultInfo *cloudflare.ResultInfo    `json:"result_info,omitempty"`
+}
+
+func writeResult(w http.ResponseWriter, status int, result interface{}, info *cloudflare.ResultInfo) {
+	writeEnvelope(w, status, envelope{
+		Success:    true,
+		Errors:     []cloudflare.ResponseInfo{},
+		Messages:   []cloudflare.ResponseInfo{},
+		Result:     result,
+		ResultInfo: info,
+	})
+}
+
+// writeError answers with the status and errors of a cloudflare.APIRequestError, or an internal error
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	errs := []cloudflare.ResponseInfo{{Code: 10001, Message: err.Error()}}
+	apiErr := &cloudflare.APIRequestError{}
+	if errors.As(err, &apiErr) {
+		status = apiErr.StatusCode
+		errs = apiErr.Errors
+	}
+	writeEnvelope(w, status, envelope{
+		Success:  false,
+		Errors:   errs,
+		Messages: []cloudflare.ResponseInfo{},
+	})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, body envelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func noRoute() error {
+	return apiError(http.StatusNotFound, 7000, "No route for that URI")
+}
+
+func methodNotAllowed() error {
+	return apiError(http.StatusMethodNotAllowed, 10000, "Method not allowed")
+}
+
+func invalidBody(err error) error {
+	return apiError(http.StatusBadRequest, 9207, "Request body is invalid: "+err.Error())
+}
+
+// Server is a local cloudflare API stand-in listening on a random port
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a Server serving the given accounts. It must be closed after use.
+func NewServer(accounts ...*Cloudflare) *Server {
+	h := NewHandler(accounts...)
+	return &Server{
+		Server:  httptest.NewServer(h),
+		Handler: h,
+	}
+}
+
+// BaseURL returns the URL to give to cloudflare-go with the cloudflare.BaseURL option
+func (s *Server) BaseURL() string {
+	return s.URL + APIPath
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudflarefake_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflarefake"
+)
+
+var _ = Describe("Server", func() {
+	const accountID = "server-account"
+	var (
+		ctx     = context.Background()
+		account *cloudflarefake.Cloudflare
+		server  *cloudflarefake.Server
+		client  controllers.CloudflareClient
+		zoneID  string
+	)
+
+	BeforeEach(func() {
+		account = cloudflarefake.New(accountID)
+		zoneID = account.AddZone("example.com")
+		server = cloudflarefake.NewServer(account)
+		server.AddToken("good-token")
+		var err error
+		client, err = controllers.NewCloudflareClientFactory(nil,
+			cloudflare.BaseURL(server.BaseURL()),
+			cloudflare.UsingRetryPolicy(0, 0, 0),
+		)("good-token", accountID)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("serves the cloudflare-go client", func() {
+		Expect(client.VerifyAPIToken(ctx)).To(HaveField("Status", "active"))
+		Expect(client.ZoneIDByName(ctx, "example.com")).To(Equal(zoneID))
+
+		tunnel, err := client.CreateArgoTunnel(ctx, "t1", "c2VjcmV0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.ID).NotTo(BeEmpty())
+		Expect(client.ArgoTunnels(ctx)).To(ConsistOf(HaveField("Name", "t1")))
+		Expect(client.ArgoTunnel(ctx, tunnel.ID)).To(And(HaveField("Name", "t1"), HaveField("DeletedAt", BeNil())))
+
+		proxied := true
+		comment := "managed by tunnel-operator"
+		record, err := client.CreateDNSRecord(ctx, zoneID, cloudflareapi.DNSRecord{
+			DNSRecord: cloudflare.DNSRecord{
+				Type: "CNAME", Name: "app.example.com", Content: tunnel.ID + ".cfargotunnel.com", Proxied: &proxied,
+			},
+			Comment: &comment,
+			Tags:    []string{"team:web"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.CommentValue()).To(Equal(comment))
+		Expect(client.UpdateDNSRecord(ctx, zoneID, record.ID, cloudflareapi.DNSRecord{
+			DNSRecord: cloudflare.DNSRecord{Content: "other.example.com"},
+		})).To(Succeed())
+		Expect(client.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{Name: "app.example.com"})).To(ConsistOf(And(
+			HaveField("Content", "other.example.com"),
+			HaveField("CommentValue()", comment),
+			HaveField("Tags", ConsistOf("team:web")),
+		)))
+		empty := ""
+		Expect(client.UpdateDNSRecord(ctx, zoneID, record.ID, cloudflareapi.DNSRecord{
+			Comment: &empty,
+			Tags:    []string{},
+		})).To(Succeed())
+		Expect(account.Records("example.com")).To(ConsistOf(And(
+			HaveField("Content", "other.example.com"),
+			HaveField("CommentValue()", BeEmpty()),
+			HaveField("Tags", BeEmpty()),
+		)))
+		Expect(client.DeleteDNSRecord(ctx, zoneID, record.ID)).To(Succeed())
+
+		Expect(client.DeleteArgoTunnel(ctx, tunnel.ID)).To(Succeed())
+		Expect(account.Tunnels()).To(BeEmpty())
+		Expect(client.ArgoTunnels(ctx)).To(ConsistOf(HaveField("DeletedAt", Not(BeNil()))))
+		Expect(client.ArgoTunnel(ctx, tunnel.ID)).To(HaveField("DeletedAt", Not(BeNil())))
+		_, err = client.ArgoTunnel(ctx, "missing")
+		Expect(err).To(MatchError(ContainSubstring("404")))
+	})
+
+	It("lists the connections of a tunnel", func() {
+		tunnel := account.AddTunnel("t1", "c2VjcmV0")
+		Expect(client.TunnelConnections(ctx, tunnel.ID)).To(BeEmpty())
+
+		openedAt := metav1.NewTime(time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC))
+		account.SetConnections(tunnel.ID,
+			tunnelv1alpha1.TunnelConnection{ID: "c1", ConnectorID: "a", ColoName: "cdg01", ClientVersion: "2022.3.0", OpenedAt: &openedAt},
+			tunnelv1alpha1.TunnelConnection{ID: "c2", ConnectorID: "b", ColoName: "ams01", OriginIP: "10.0.0.2", IsPendingReconnect: true},
+			tunnelv1alpha1.TunnelConnection{ID: "c3", ConnectorID: "a", ColoName: "fra01"},
+		)
+		connections, err := client.TunnelConnections(ctx, tunnel.ID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(connections).To(HaveLen(3))
+		Expect(connections[0]).To(And(
+			HaveField("ID", "c1"),
+			HaveField("ConnectorID", "a"),
+			HaveField("ColoName", "cdg01"),
+			HaveField("ClientVersion", "2022.3.0"),
+		))
+		Expect(connections[0].OpenedAt.Equal(&openedAt)).To(BeTrue())
+		Expect(connections).To(ContainElement(And(
+			HaveField("ID", "c2"),
+			HaveField("OriginIP", "10.0.0.2"),
+			HaveField("IsPendingReconnect", true),
+		)))
+
+		_, err = client.TunnelConnections(ctx, "missing")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reads and updates the remote configuration of a tunnel", func() {
+		tunnel := account.AddTunnel("t1", "c2VjcmV0")
+		_, managed := account.Configuration(tunnel.ID)
+		Expect(managed).To(BeFalse())
+		Expect(client.TunnelConfiguration(ctx, tunnel.ID)).To(HaveField("Ingress", BeEmpty()))
+
+		config := cloudflareapi.TunnelConfiguration{Ingress: []cloudflareapi.TunnelIngressRule{
+			{Hostname: "app.example.com", Service: "http://app:8080", OriginRequest: map[string]interface{}{"connectTimeout": float64(30)}},
+			{Service: "http_status:404"},
+		}}
+		Expect(client.UpdateTunnelConfiguration(ctx, tunnel.ID, config)).To(Succeed())
+		remote, managed := account.Configuration(tunnel.ID)
+		Expect(managed).To(BeTrue())
+		Expect(remote).To(Equal(config))
+		Expect(client.TunnelConfiguration(ctx, tunnel.ID)).To(Equal(config))
+
+		Expect(client.UpdateTunnelConfiguration(ctx, "missing", config)).NotTo(Succeed())
+		_, err := client.TunnelConfiguration(ctx, "missing")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("paginates DNS records", func() {
+		for i := 0; i < 250; i++ {
+			_, err := account.AddRecord("example.com", cloudflareapi.DNSRecord{DNSRecord: cloudflare.DNSRecord{
+				Type: "TXT", Name: fmt.Sprintf("r%d.example.com", i), Content: "txt",
+			}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(client.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{Type: "TXT"})).To(HaveLen(250))
+		Expect(account.CallCount(cloudflarefake.MethodDNSRecords)).To(Equal(3))
+	})
+
+	It("answers with cloudflare error envelopes", func() {
+		account.FailNext(cloudflarefake.MethodCreateArgoTunnel, &cloudflare.APIRequestError{
+			StatusCode: http.StatusConflict,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1013, Message: "You already have a named tunnel with this name."}},
+		})
+		_, err := client.CreateArgoTunnel(ctx, "t1", "c2VjcmV0")
+		apiErr := &cloudflare.APIRequestError{}
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.StatusCode).To(Equal(http.StatusConflict))
+		Expect(apiErr.InternalErrorCodeIs(1013)).To(BeTrue())
+
+		err = client.DeleteDNSRecord(ctx, zoneID, "missing")
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.StatusCode).To(Equal(http.StatusNotFound))
+
+		bad, err := controllers.NewCloudflareClientFactory(nil, cloudflare.BaseURL(server.BaseURL()))("bad-token", accountID)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = bad.ArgoTunnels(ctx)
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("cancels the requests with their context", func() {
+		tunnel := account.AddTunnel("t1", "c2VjcmV0")
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		Expect(client.UpdateTunnelSecret(canceled, tunnel.ID, "bmV3")).To(MatchError(context.Canceled))
+		_, err := client.TunnelConnections(canceled, tunnel.ID)
+		Expect(err).To(MatchError(context.Canceled))
+		_, err = client.DNSRecords(canceled, zoneID, cloudflare.DNSRecord{})
+		Expect(err).To(MatchError(context.Canceled))
+		_, err = client.ZoneIDByName(canceled, "example.com")
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(account.Calls()).To(BeEmpty())
+	})
+
+	It("rate limits requests with a Retry-After header", func() {
+		server.RateLimitNext(1, 30*time.Second)
+		resp, err := http.Get(server.BaseURL() + "/user/tokens/verify")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(resp.Header.Get("Retry-After")).To(Equal("30"))
+
+		server.RateLimitNext(1, time.Second)
+		_, err = client.ArgoTunnels(ctx)
+		apiErr := &cloudflare.APIRequestError{}
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.ClientRateLimited()).To(BeTrue())
+	})
+
+	It("pauses all the clients sharing a RateLimitedTransport until Retry-After expires", func() {
+		sent := 0
+		transport := controllers.NewRateLimitedTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent++
+			return http.DefaultTransport.RoundTrip(req)
+		}), 100, 1)
+		newClient := func() controllers.CloudflareClient {
+			c, err := controllers.NewCloudflareClientFactory(&http.Client{Transport: transport},
+				cloudflare.BaseURL(server.BaseURL()),
+				cloudflare.UsingRetryPolicy(0, 0, 0),
+			)("good-token", accountID)
+			Expect(err).NotTo(HaveOccurred())
+			return c
+		}
+		first, second := newClient(), newClient()
+
+		server.RateLimitNext(1, time.Second)
+		_, err := first.ArgoTunnels(ctx)
+		limited := &controllers.RateLimitedError{}
+		Expect(errors.As(err, &limited)).To(BeTrue())
+		Expect(limited.RetryAfter).To(Equal(time.Second))
+		Expect(sent).To(Equal(1))
+
+		_, err = second.ArgoTunnels(ctx)
+		Expect(errors.As(err, &limited)).To(BeTrue())
+		Expect(limited.RetryAfter).To(BeNumerically("<=", time.Second))
+		Expect(sent).To(Equal(1))
+
+		Eventually(func() error {
+			_, err := second.ArgoTunnels(ctx)
+			return err
+		}, 3*time.Second, 100*time.Millisecond).Should(Succeed())
+		Expect(sent).To(Equal(2))
+	})
+
+	It("spreads the requests of a RateLimitedTransport over time", func() {
+		transport := controllers.NewRateLimitedTransport(nil, 20, 1)
+		c, err := controllers.NewCloudflareClientFactory(&http.Client{Transport: transport},
+			cloudflare.BaseURL(server.BaseURL()),
+		)("good-token", accountID)
+		Expect(err).NotTo(HaveOccurred())
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			_, err := c.ArgoTunnels(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", 150*time.Millisecond))
+	})
+
+	It("sends the bursts of a rate limited client factory at once and does not retry rate limited requests", func() {
+		c, err := controllers.NewRateLimitedCloudflareClientFactory(1, 6,
+			cloudflare.BaseURL(server.BaseURL()),
+		)("good-token", accountID)
+		Expect(err).NotTo(HaveOccurred())
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			_, err := c.ArgoTunnels(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+		server.RateLimitNext(1, time.Minute)
+		start = time.Now()
+		_, err = c.ArgoTunnels(ctx)
+		limited := &controllers.RateLimitedError{}
+		Expect(errors.As(err, &limited)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+})
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
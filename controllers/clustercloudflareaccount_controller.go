@@ -0,0 +1,116 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// ClusterCloudflareAccountReconciler reconciles a ClusterCloudflareAccount object
+type ClusterCloudflareAccountReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// NewCloudflareClient creates the clients used to reach cloudflare, defaults to NewCloudflareClient
+	NewCloudflareClient CloudflareClientFactory
+}
+
+//+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=clustercloudflareaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=clustercloudflareaccounts/status,verbs=get;update;patch
+
+// Reconcile verifies the API token of a ClusterCloudflareAccount and reports it in its Ready condition
+func (r *ClusterCloudflareAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+
+	account := &tunnelv1alpha1.ClusterCloudflareAccount{}
+	if err := r.Get(ctx, req.NamespacedName, account); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Failed to get ClusterCloudflareAccount")
+		return ctrl.Result{}, err
+	}
+
+	condition := accountNotReady(tunnelv1alpha1.CloudflareAccountConditionSecretInvalidReason,
+		"apiTokenSecretRef.namespace is required for a ClusterCloudflareAccount")
+	if account.Spec.APITokenSecretRef.Namespace != "" {
+		var err error
+		condition, err = verifyAccount(ctx, r.Client, r.NewCloudflareClient, account.Spec.APITokenSecretRef.Namespace, account.Spec)
+		if retryAfter, limited := rateLimitRetryAfter(err); limited {
+			log.Info("cloudflare API rate limit reached", "retryAfter", retryAfter)
+			return ctrl.Result{RequeueAfter: retryAfter}, nil
+		}
+		if err != nil {
+			log.Error(err, "failed to verify cloudflare account")
+			return ctrl.Result{}, err
+		}
+	}
+	condition.ObservedGeneration = account.Generation
+	apimeta.SetStatusCondition(&account.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, account); err != nil {
+		log.Error(err, "Failed to update ClusterCloudflareAccount status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: accountVerifyInterval}, nil
+}
+
+// accountsForSecret maps a secret to the ClusterCloudflareAccounts holding their token in it
+func (r *ClusterCloudflareAccountReconciler) accountsForSecret(secret client.Object) []reconcile.Request {
+	accounts := &tunnelv1alpha1.ClusterCloudflareAccountList{}
+	err := r.List(context.Background(), accounts,
+		client.MatchingFields{apiTokenSecretIndexKey: secret.GetNamespace() + "/" + secret.GetName()})
+	if err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, a := range accounts.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: a.Name},
+		})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterCloudflareAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &tunnelv1alpha1.ClusterCloudflareAccount{}, apiTokenSecretIndexKey,
+		func(o client.Object) []string {
+			ref := o.(*tunnelv1alpha1.ClusterCloudflareAccount).Spec.APITokenSecretRef
+			return []string{ref.Namespace + "/" + ref.Name}
+		})
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&tunnelv1alpha1.ClusterCloudflareAccount{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.accountsForSecret)).
+		Complete(r)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+const (
+	// DefaultConnectionsPollPeriod is the default period at which the connections of tunnels are polled
+	DefaultConnectionsPollPeriod = time.Minute
+	// DefaultDisconnectedThreshold is the default time after which a tunnel without connections is reported disconnected
+	DefaultDisconnectedThreshold = 2 * time.Minute
+)
+
+// disconnectedThreshold returns the time after which a tunnel without connections is reported disconnected
+func (r *TunnelReconciler) disconnectedThreshold() time.Duration {
+	if r.DisconnectedThreshold > 0 {
+		return r.DisconnectedThreshold
+	}
+	return DefaultDisconnectedThreshold
+}
+
+// pollSchedule records when something is due to be read again from cloudflare for each tunnel
+type pollSchedule struct {
+	mu  sync.Mutex
+	due map[string]time.Time
+}
+
+// dueIn returns the delay before the tunnel tunnelID is due, zero or less when it is due
+func (p *pollSchedule) dueIn(tunnelID string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Until(p.due[tunnelID])
+}
+
+// schedule records that the tunnel tunnelID is due again after the given delay
+func (p *pollSchedule) schedule(tunnelID string, after time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.due == nil {
+		p.due = map[string]time.Time{}
+	}
+	p.due[tunnelID] = time.Now().Add(after)
+}
+
+// forget drops the schedule of the tunnel tunnelID
+func (p *pollSchedule) forget(tunnelID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.due, tunnelID)
+}
+
+// pollConnections updates the connections of the tunnel of t once they are due, and returns the delay after which
+// they are due again, zero when polling is disabled. A failed poll is reported in the Connected condition rather
+// than failing the reconciliation.
+func (r *TunnelReconciler) pollConnections(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel) time.Duration {
+	if r.ConnectionsPollPeriod <= 0 {
+		apimeta.RemoveStatusCondition(&t.Status.Conditions, tunnelv1alpha1.TunnelConditionConnectedType)
+		return 0
+	}
+	if dueIn := r.connectionPolls.dueIn(t.Status.TunnelID); dueIn > 0 {
+		return dueIn
+	}
+	pollAfter, err := r.updateConnections(ctx, CF, t)
+	if err != nil {
+		setTunnelCondition(t, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionConnectedType,
+			Status:  metav1.ConditionUnknown,
+			Reason:  tunnelv1alpha1.TunnelConditionConnectedFailedReason,
+			Message: "Failed to list the connections of the tunnel: " + err.Error(),
+		})
+		pollAfter = r.ConnectionsPollPeriod
+	}
+	r.connectionPolls.schedule(t.Status.TunnelID, pollAfter)
+	return pollAfter
+}
+
+// updateConnections records the connections of the tunnel of t reported by the cloudflare edge in its status,
+// and sets its Connected condition. The condition turns False once the edge reports no active connection for
+// longer than the disconnected threshold. It returns the delay after which the connections should be polled
+// again.
+func (r *TunnelReconciler) updateConnections(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel) (time.Duration, error) {
+	log := ctrllog.FromContext(ctx)
+	connections, err := CF.Client().TunnelConnections(ctx, t.Status.TunnelID)
+	if err != nil {
+		log.Error(err, "failed to list the connections of cloudflare tunnel "+t.Status.TunnelID)
+		return 0, err
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].ConnectorID != connections[j].ConnectorID {
+			return connections[i].ConnectorID < connections[j].ConnectorID
+		}
+		return connections[i].ID < connections[j].ID
+	})
+	active := int32(0)
+	connectors := map[string]bool{}
+	for _, c := range connections {
+		if !c.IsPendingReconnect {
+			active++
+			connectors[c.ConnectorID] = true
+		}
+	}
+	t.Status.Connections = connections
+	t.Status.ActiveConnections = active
+
+	pollAfter := r.ConnectionsPollPeriod
+	if active > 0 {
+		t.Status.DisconnectedSince = nil
+		setTunnelCondition(t, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionConnectedType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionConnectedSuccessReason,
+			Message: fmt.Sprintf("%d active connections from %d connectors", active, len(connectors)),
+		})
+		return pollAfter, nil
+	}
+
+	if t.Status.DisconnectedSince == nil {
+		now := metav1.Now()
+		t.Status.DisconnectedSince = &now
+	}
+	since := t.Status.DisconnectedSince
+	threshold := r.disconnectedThreshold()
+	if remaining := threshold - time.Since(since.Time); remaining > 0 {
+		// connectors may be starting or reconnecting: the condition is left as is until the threshold is reached
+		if apimeta.FindStatusCondition(t.Status.Conditions, tunnelv1alpha1.TunnelConditionConnectedType) == nil {
+			setTunnelCondition(t, metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionConnectedType,
+				Status:  metav1.ConditionUnknown,
+				Reason:  tunnelv1alpha1.TunnelConditionConnectedAwaitingReason,
+				Message: "Waiting up to " + threshold.String() + " for a connector to connect to the cloudflare edge",
+			})
+		}
+		if remaining < pollAfter {
+			pollAfter = remaining
+		}
+		return pollAfter, nil
+	}
+	setTunnelCondition(t, metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionConnectedType,
+		Status:  metav1.ConditionFalse,
+		Reason:  tunnelv1alpha1.TunnelConditionConnectedNoneReason,
+		Message: "The cloudflare edge reports no active connection since " + since.UTC().Format(time.RFC3339),
+	})
+	return pollAfter, nil
+}
+
+// minRequeueAfter returns the shortest of the given delays, ignoring the zero ones which disable requeuing
+func minRequeueAfter(delays ...time.Duration) time.Duration {
+	min := time.Duration(0)
+	for _, d := range delays {
+		if d > 0 && (min == 0 || d < min) {
+			min = d
+		}
+	}
+	return min
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// Keys expected in the secret referenced by a Tunnel's spec.accountSecret.
+// They match the environment variables used when no secret is referenced.
+const (
+	accountSecretAPITokenKey  = "CLOUDFLARE_API_TOKEN"
+	accountSecretAccountIDKey = "CLOUDFLARE_ACCOUNT_ID"
+	accountSecretZoneNameKey  = "CLOUDFLARE_ZONE_NAME"
+)
+
+// cloudflareCredentials identifies a cloudflare account and DNS zone to manage tunnels in
+type cloudflareCredentials struct {
+	APIToken  string
+	AccountID string
+	ZoneName  string
+	// Source is where the credentials were read from, their previous client is dropped once they change
+	Source string
+}
+
+// credentialsError reports a problem with the credentials referenced by a Tunnel.
+// Reason is used as the reason of the Tunnel credentials condition.
+type credentialsError struct {
+	Reason  string
+	Message string
+}
+
+func (e *credentialsError) Error() string {
+	return e.Message
+}
+
+// credentialsFromEnv returns the operator-wide credentials from the environment
+func credentialsFromEnv() cloudflareCredentials {
+	return cloudflareCredentials{
+		APIToken:  os.Getenv(accountSecretAPITokenKey),
+		AccountID: os.Getenv(accountSecretAccountIDKey),
+		ZoneName:  os.Getenv(accountSecretZoneNameKey),
+		Source:    "environment",
+	}
+}
+
+// readSecretKey returns the value of a secret entry, or a credentialsError
+// when the secret does not exist or lacks the entry
+func readSecretKey(ctx context.Context, c client.Reader, namespace string, ref tunnelv1alpha1.SecretKeyReference) (string, error) {
+	key := ref.Key
+	if key == "" {
+		key = accountSecretAPITokenKey
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", &credentialsError{
+				Reason:  tunnelv1alpha1.TunnelConditionCredentialsNotFoundReason,
+				Message: "secret " + namespace + "/" + ref.Name + " not found",
+			}
+		}
+		return "", err
+	}
+	value := string(secret.Data[key])
+	if value == "" {
+		return "", &credentialsError{
+			Reason:  tunnelv1alpha1.TunnelConditionCredentialsInvalidReason,
+			Message: "secret " + namespace + "/" + ref.Name + " is missing key " + key,
+		}
+	}
+	return value, nil
+}
+
+// credentialsForTunnel resolves the cloudflare credentials of a tunnel from its
+// spec.accountRef or spec.accountSecret, falling back to the operator environment
+// when none is set
+func (r *TunnelReconciler) credentialsForTunnel(ctx context.Context, t *tunnelv1alpha1.Tunnel) (cloudflareCredentials, error) {
+	if t.Spec.AccountRef != nil {
+		return r.credentialsFromAccountRef(ctx, t)
+	}
+	ref := t.Spec.AccountSecret
+	if ref == nil {
+		creds := credentialsFromEnv()
+		if creds.APIToken == "" {
+			return creds, &credentialsError{
+				Reason:  tunnelv1alpha1.TunnelConditionCredentialsInvalidReason,
+				Message: "no accountSecret specified and missing environment variable " + accountSecretAPITokenKey,
+			}
+		}
+		return creds, nil
+	}
+
+	// secrets are only looked up in the Tunnel namespace so that a Tunnel
+	// cannot borrow the cloudflare account of another namespace
+	if ref.Namespace != "" && ref.Namespace != t.Namespace {
+		return cloudflareCredentials{}, &credentialsError{
+			Reason:  tunnelv1alpha1.TunnelConditionCredentialsInvalidReason,
+			Message: "accountSecret must be in the Tunnel namespace " + t.Namespace,
+		}
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: t.Namespace, Name: ref.Name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return cloudflareCredentials{}, &credentialsError{
+				Reason:  tunnelv1alpha1.TunnelConditionCredentialsNotFoundReason,
+				Message: "account secret " + ref.Name + " not found",
+			}
+		}
+		return cloudflareCredentials{}, err
+	}
+
+	creds := cloudflareCredentials{
+		APIToken:  string(secret.Data[accountSecretAPITokenKey]),
+		AccountID: string(secret.Data[accountSecretAccountIDKey]),
+		ZoneName:  string(secret.Data[accountSecretZoneNameKey]),
+		Source:    "secret " + t.Namespace + "/" + ref.Name,
+	}
+	missingKey := ""
+	if creds.APIToken == "" {
+		missingKey = accountSecretAPITokenKey
+	} else if creds.AccountID == "" {
+		missingKey = accountSecretAccountIDKey
+	}
+	if missingKey != "" {
+		return creds, &credentialsError{
+			Reason:  tunnelv1alpha1.TunnelConditionCredentialsInvalidReason,
+			Message: "account secret " + ref.Name + " is missing key " + missingKey,
+		}
+	}
+	return creds, nil
+}
+
+// credentialsFromAccountRef resolves the credentials of a tunnel from the
+// CloudflareAccount or ClusterCloudflareAccount it references
+func (r *TunnelReconciler) credentialsFromAccountRef(ctx context.Context, t *tunnelv1alpha1.Tunnel) (cloudflareCredentials, error) {
+	ref := t.Spec.AccountRef
+	kind := ref.Kind
+	if kind == "" {
+		kind = tunnelv1alpha1.CloudflareAccountKind
+	}
+	var spec tunnelv1alpha1.CloudflareAccountSpec
+	var status tunnelv1alpha1.CloudflareAccountStatus
+	var secretNamespace, source string
+	var generation int64
+	var allowed bool
+	var err error
+	if kind == tunnelv1alpha1.ClusterCloudflareAccountKind {
+		account := &tunnelv1alpha1.ClusterCloudflareAccount{}
+		err = r.Get(ctx, client.ObjectKey{Name: ref.Name}, account)
+		spec, status, generation = account.Spec, account.Status, account.Generation
+		secretNamespace = account.Spec.APITokenSecretRef.Namespace
+		source = kind + " " + ref.Name
+		allowed = account.IsNamespaceAllowed(t.Namespace)
+	} else {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = t.Namespace
+		}
+		account := &tunnelv1alpha1.CloudflareAccount{}
+		err = r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, account)
+		spec, status, generation = account.Spec, account.Status, account.Generation
+		secretNamespace = account.Namespace
+		source = kind + " " + namespace + "/" + ref.Name
+		allowed = account.IsNamespaceAllowed(t.Namespace)
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return cloudflareCredentials{}, &credentialsError{
+				Reason:  tunnelv1alpha1.TunnelConditionCredentialsAccountNotFoundReason,
+				Message: kind + " " + ref.Name + " not found",
+			}
+		}
+		return cloudflareCredentials{}, err
+	}
+	if !allowed {
+		return cloudflareCredentials{}, &credentialsError{
+			Reason:  tunnelv1alpha1.TunnelConditionCredentialsAccountNotAllowedReason,
+			Message: kind + " " + ref.Name + " does not allow namespace " + t.Namespace,
+		}
+	}
+	// the Ready condition of a previous generation may hold for a token or an account that is not verified yet
+	ready := apimeta.FindStatusCondition(status.Conditions, tunnelv1alpha1.CloudflareAccountConditionReadyType)
+	if ready == nil || ready.Status != metav1.ConditionTrue || ready.ObservedGeneration != generation {
+		return cloudflareCredentials{}, &credentialsError{
+			Reason:  tunnelv1alpha1.TunnelConditionCredentialsAccountNotReadyReason,
+			Message: kind + " " + ref.Name + " is not ready",
+		}
+	}
+
+	token, err := readSecretKey(ctx, r.Client, secretNamespace, spec.APITokenSecretRef)
+	if err != nil {
+		return cloudflareCredentials{}, err
+	}
+	creds := cloudflareCredentials{
+		APIToken:  token,
+		AccountID: spec.AccountID,
+		Source:    source,
+	}
+	if len(spec.Zones) > 0 {
+		creds.ZoneName = spec.Zones[0]
+	}
+	return creds, nil
+}
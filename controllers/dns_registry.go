@@ -0,0 +1,164 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// DefaultDNSOwnerID is the default ID of an operator instance in the TXT records claiming the CNAME records it manages
+const DefaultDNSOwnerID = "default"
+
+const (
+	// dnsOwnershipPrefix is prepended to the name of a CNAME record to name the TXT record of its owner
+	dnsOwnershipPrefix = "_tunnel-operator."
+	// dnsOwnershipWildcardPrefix replaces the wildcard of a CNAME record in the name of the TXT record of its owner,
+	// as a wildcard is only valid as the first label of a name
+	dnsOwnershipWildcardPrefix = "_tunnel-operator-wildcard."
+	dnsOwnershipHeritage       = "heritage=tunnel-operator"
+	dnsOwnershipOwnerKey       = "tunnel-operator/owner="
+	dnsOwnershipResourceKey    = "tunnel-operator/resource="
+)
+
+// errDNSRecordNotOwned is returned when modifying or deleting a record which is not owned by the Tunnel
+var errDNSRecordNotOwned = errors.New("not owned by the Tunnel")
+
+// notOwnedError returns errDNSRecordNotOwned for the CNAME record of hostname
+func notOwnedError(hostname string) error {
+	return fmt.Errorf("CNAME record %s is %w", hostname, errDNSRecordNotOwned)
+}
+
+// dnsOwner identifies the operator instance and the Tunnel owning a CNAME record
+type dnsOwner struct {
+	// ID is the owner ID of the operator instance
+	ID string
+	// Resource is the namespace and name of the Tunnel
+	Resource string
+}
+
+// tunnelDNSOwner returns the owner of the CNAME records of t for the operator instance ownerID
+func tunnelDNSOwner(ownerID string, t *tunnelv1alpha1.Tunnel) dnsOwner {
+	if ownerID == "" {
+		ownerID = DefaultDNSOwnerID
+	}
+	return dnsOwner{ID: ownerID, Resource: "tunnel/" + t.Namespace + "/" + t.Name}
+}
+
+func (o dnsOwner) String() string {
+	return o.Resource + " of operator " + o.ID
+}
+
+// txtContent returns the content of the TXT record claiming a CNAME record for o
+func (o dnsOwner) txtContent() string {
+	return `"` + dnsOwnershipHeritage + "," + dnsOwnershipOwnerKey + o.ID + "," + dnsOwnershipResourceKey + o.Resource + `"`
+}
+
+// parseDNSOwner returns the owner recorded in the content of a TXT record, false if it is not an ownership record
+func parseDNSOwner(content string) (dnsOwner, bool) {
+	content = strings.Trim(content, `"`)
+	owner := dnsOwner{}
+	heritage := false
+	for _, field := range strings.Split(content, ",") {
+		switch {
+		case field == dnsOwnershipHeritage:
+			heritage = true
+		case strings.HasPrefix(field, dnsOwnershipOwnerKey):
+			owner.ID = strings.TrimPrefix(field, dnsOwnershipOwnerKey)
+		case strings.HasPrefix(field, dnsOwnershipResourceKey):
+			owner.Resource = strings.TrimPrefix(field, dnsOwnershipResourceKey)
+		}
+	}
+	return owner, heritage && owner.ID != ""
+}
+
+// ownershipRecordName returns the name of the TXT record claiming the CNAME record of hostname
+func ownershipRecordName(hostname string) string {
+	if strings.HasPrefix(hostname, "*.") {
+		return dnsOwnershipWildcardPrefix + strings.TrimPrefix(hostname, "*.")
+	}
+	return dnsOwnershipPrefix + hostname
+}
+
+// DNSRecordOwner returns the owner claiming the CNAME record of hostname in the zone zoneID,
+// and false when the record is not claimed
+func (c *Cloudflare) DNSRecordOwner(ctx context.Context, zoneID, hostname string) (dnsOwner, bool, error) {
+	owner, _, found, err := c.ownershipRecord(ctx, zoneID, hostname)
+	return owner, found, err
+}
+
+// ownershipRecord returns the owner claiming the CNAME record of hostname and the TXT record holding it
+func (c *Cloudflare) ownershipRecord(ctx context.Context, zoneID, hostname string) (dnsOwner, *cloudflareapi.DNSRecord, bool, error) {
+	tpl := cloudflare.DNSRecord{Type: "TXT", Name: ownershipRecordName(hostname)}
+	records, err := c.client.DNSRecords(ctx, zoneID, tpl)
+	if err != nil {
+		return dnsOwner{}, nil, false, err
+	}
+	for _, record := range records {
+		if owner, ok := parseDNSOwner(record.Content); ok {
+			return owner, &record, true, nil
+		}
+	}
+	return dnsOwner{}, nil, false, nil
+}
+
+// ClaimDNSRecord writes the TXT record claiming the CNAME record of hostname for owner.
+// It fails with errDNSRecordNotOwned when the record is claimed by another owner.
+func (c *Cloudflare) ClaimDNSRecord(ctx context.Context, zoneID, hostname string, owner dnsOwner) error {
+	current, _, found, err := c.ownershipRecord(ctx, zoneID, hostname)
+	if err != nil {
+		return err
+	}
+	if found {
+		if current != owner {
+			return notOwnedError(hostname)
+		}
+		return nil
+	}
+	ctrllog.FromContext(ctx).Info("claiming CNAME record " + hostname + " for " + owner.String())
+	_, err = c.client.CreateDNSRecord(ctx, zoneID, cloudflareapi.DNSRecord{
+		DNSRecord: cloudflare.DNSRecord{Type: "TXT", Name: ownershipRecordName(hostname), Content: owner.txtContent(), TTL: 1},
+	})
+	return err
+}
+
+// ownsDNSRecord returns whether the CNAME record of hostname is claimed by owner
+func (c *Cloudflare) ownsDNSRecord(ctx context.Context, zoneID, hostname string, owner dnsOwner) (bool, error) {
+	current, found, err := c.DNSRecordOwner(ctx, zoneID, hostname)
+	if err != nil {
+		return false, err
+	}
+	return found && current == owner, nil
+}
+
+// releaseDNSRecord deletes the TXT record claiming the CNAME record of hostname for owner
+func (c *Cloudflare) releaseDNSRecord(ctx context.Context, zoneID, hostname string, owner dnsOwner) error {
+	current, record, found, err := c.ownershipRecord(ctx, zoneID, hostname)
+	if err != nil || !found || current != owner {
+		return err
+	}
+	ctrllog.FromContext(ctx).Info("releasing CNAME record " + hostname + " from " + owner.String())
+	return c.client.DeleteDNSRecord(ctx, zoneID, record.ID)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// ResolveZone returns the zone holding the records of hostname, among the zones of the account accessible with the
+// API token: the zone named zoneName when set, else the zone with the longest name hostname ends with.
+// It returns false when no such zone contains hostname.
+func (c *Cloudflare) ResolveZone(ctx context.Context, hostname, zoneName string) (cloudflare.Zone, bool, error) {
+	zones, err := c.client.ListZones(ctx)
+	if err != nil {
+		return cloudflare.Zone{}, false, err
+	}
+	zone, found := zoneForHostname(zones, c.client.AccountID(), hostname, zoneName)
+	return zone, found, nil
+}
+
+// zoneForHostname returns the zone of accountID holding hostname, the one named zoneName when set
+func zoneForHostname(zones []cloudflare.Zone, accountID, hostname, zoneName string) (cloudflare.Zone, bool) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	var best cloudflare.Zone
+	found := false
+	for _, zone := range zones {
+		if accountID != "" && zone.Account.ID != "" && zone.Account.ID != accountID {
+			continue
+		}
+		name := strings.ToLower(zone.Name)
+		if hostname != name && !strings.HasSuffix(hostname, "."+name) {
+			continue
+		}
+		if zoneName != "" && !strings.EqualFold(zoneName, zone.Name) {
+			continue
+		}
+		if !found || len(name) > len(best.Name) {
+			best = zone
+			found = true
+		}
+	}
+	return best, found
+}
+
+// recordedZoneID returns the ID of the zone in which the record of hostname was created, empty if unknown
+func recordedZoneID(t *tunnelv1alpha1.Tunnel, hostname string) string {
+	for _, z := range t.Status.DNSZones {
+		if z.Hostname == hostname {
+			return z.ZoneID
+		}
+	}
+	return ""
+}
+
+// setRecordedZone records in the status of t the zone in which the record of hostname was created
+func setRecordedZone(t *tunnelv1alpha1.Tunnel, hostname string, zone cloudflare.Zone) {
+	recorded := tunnelv1alpha1.TunnelDNSZone{Hostname: hostname, ZoneID: zone.ID, ZoneName: zone.Name}
+	for i := range t.Status.DNSZones {
+		if t.Status.DNSZones[i].Hostname == hostname {
+			t.Status.DNSZones[i] = recorded
+			return
+		}
+	}
+	t.Status.DNSZones = append(t.Status.DNSZones, recorded)
+}
+
+// removeRecordedZone forgets the zone of hostname in the status of t
+func removeRecordedZone(t *tunnelv1alpha1.Tunnel, hostname string) {
+	zones := []tunnelv1alpha1.TunnelDNSZone{}
+	for _, z := range t.Status.DNSZones {
+		if z.Hostname != hostname {
+			zones = append(zones, z)
+		}
+	}
+	t.Status.DNSZones = zones
+}
+
+// hostnameZoneID returns the ID of the zone holding the record of hostname: the zone recorded in the status of t,
+// or the zone resolved from hostname for the tunnels created before the zones were recorded.
+// It returns an empty ID when hostname belongs to no accessible zone.
+func hostnameZoneID(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel, hostname string) (string, error) {
+	if zoneID := recordedZoneID(t, hostname); zoneID != "" {
+		return zoneID, nil
+	}
+	zone, found, err := CF.ResolveZone(ctx, hostname, "")
+	if err != nil || !found {
+		return "", err
+	}
+	return zone.ID, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// DefaultResyncPeriod is the default period after which tunnels are verified against cloudflare
+const DefaultResyncPeriod = 10 * time.Minute
+
+// resyncPeriod returns the period after which t is verified against cloudflare, zero when disabled
+func (r *TunnelReconciler) resyncPeriod(t *tunnelv1alpha1.Tunnel) time.Duration {
+	if t.Spec.ResyncPeriod != nil {
+		return t.Spec.ResyncPeriod.Duration
+	}
+	return r.ResyncPeriod
+}
+
+// checkDrift verifies the DNS records of the ingress rules of t against cloudflare and reports the differences
+// in the Drifted condition. The differences are corrected when spec.correctDrift is set.
+func (r *TunnelReconciler) checkDrift(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel) error {
+	log := ctrllog.FromContext(ctx)
+	differences := []string{}
+	corrected := []string{}
+	if t.Spec.Ingress != nil {
+		for _, ingress := range *t.Spec.Ingress {
+			if dnsSkipped(ingress) {
+				continue
+			}
+			zoneID := recordedZoneID(t, ingress.HostName)
+			if zoneID == "" {
+				// hostnames without accessible zone are reported in the DNSReady condition
+				continue
+			}
+			desired := tunnelDNSRecord(t, ingress.HostName, ingress.DNS)
+			record, diffs, err := CF.TunnelDNSRecordDrift(ctx, zoneID, desired)
+			if err != nil {
+				log.Error(err, "failed to verify CNAME record "+ingress.HostName)
+				return err
+			}
+			if len(diffs) == 0 {
+				continue
+			}
+			if !t.Spec.CorrectDrift {
+				differences = append(differences, diffs...)
+				continue
+			}
+			err = CF.CorrectTunnelDNSRecord(ctx, zoneID, record, desired, tunnelDNSOwner(r.DNSOwnerID, t))
+			if errors.Is(err, errDNSRecordNotOwned) {
+				// records owned elsewhere are reported but never modified
+				differences = append(differences, append(diffs, err.Error())...)
+				continue
+			}
+			if err != nil {
+				log.Error(err, "failed to correct CNAME record "+ingress.HostName)
+				return err
+			}
+			corrected = append(corrected, diffs...)
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionDriftedType,
+		Status:  metav1.ConditionFalse,
+		Reason:  tunnelv1alpha1.TunnelConditionDriftedInSyncReason,
+		Message: "The tunnel DNS records match the Tunnel",
+	}
+	switch {
+	case len(differences) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = tunnelv1alpha1.TunnelConditionDriftedDetectedReason
+		condition.Message = strings.Join(differences, "; ")
+	case len(corrected) > 0:
+		condition.Reason = tunnelv1alpha1.TunnelConditionDriftedCorrectedReason
+		condition.Message = "Corrected: " + strings.Join(corrected, "; ")
+		r.Recorder.Event(t, corev1.EventTypeNormal, "DriftCorrected", condition.Message)
+	}
+	if !setTunnelCondition(t, condition) {
+		return nil
+	}
+	if condition.Status == metav1.ConditionTrue {
+		r.Recorder.Event(t, corev1.EventTypeWarning, "DriftDetected", condition.Message)
+	}
+	if err := r.updateStatus(ctx, t); err != nil {
+		log.Error(err, "Failed to update Tunnel status")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+const metricsNamespace = "tunnel_operator"
+
+var (
+	cloudflareAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cloudflare_api_requests_total",
+		Help:      "Number of calls to the cloudflare API, per operation.",
+	}, []string{"operation"})
+
+	cloudflareAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cloudflare_api_request_duration_seconds",
+		Help:      "Duration of the calls to the cloudflare API, per operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	cloudflareAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cloudflare_api_errors_total",
+		Help:      "Number of failed calls to the cloudflare API, per operation and HTTP status code, none when no response was received.",
+	}, []string{"operation", "status_code"})
+)
+
+var (
+	tunnelsDesc = prometheus.NewDesc(metricsNamespace+"_tunnels",
+		"Number of Tunnels managed by the operator.", nil, nil)
+	tunnelDNSRecordsDesc = prometheus.NewDesc(metricsNamespace+"_tunnel_dns_records",
+		"Number of DNS records of a Tunnel.", []string{"namespace", "name"}, nil)
+	tunnelConditionsDesc = prometheus.NewDesc(metricsNamespace+"_tunnel_conditions",
+		"Number of Tunnels per condition type and status.", []string{"type", "status"}, nil)
+)
+
+// tunnelCollector collects the metrics of the Tunnels from the cache of the manager on each scrape,
+// so that the metrics of deleted tunnels disappear with them
+type tunnelCollector struct {
+	client client.Reader
+}
+
+func (c *tunnelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelsDesc
+	ch <- tunnelDNSRecordsDesc
+	ch <- tunnelConditionsDesc
+}
+
+func (c *tunnelCollector) Collect(ch chan<- prometheus.Metric) {
+	tunnels := &tunnelv1alpha1.TunnelList{}
+	if err := c.client.List(context.Background(), tunnels); err != nil {
+		ch <- prometheus.NewInvalidMetric(tunnelsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(tunnelsDesc, prometheus.GaugeValue, float64(len(tunnels.Items)))
+
+	conditions := map[string]map[metav1.ConditionStatus]int{}
+	for _, t := range tunnels.Items {
+		ch <- prometheus.MustNewConstMetric(tunnelDNSRecordsDesc, prometheus.GaugeValue,
+			float64(len(t.Status.IngressHostnames)), t.Namespace, t.Name)
+		for _, condition := range t.Status.Conditions {
+			if conditions[condition.Type] == nil {
+				conditions[condition.Type] = map[metav1.ConditionStatus]int{}
+			}
+			conditions[condition.Type][condition.Status]++
+		}
+	}
+	for conditionType, counts := range conditions {
+		for _, status := range []metav1.ConditionStatus{metav1.ConditionTrue, metav1.ConditionFalse, metav1.ConditionUnknown} {
+			ch <- prometheus.MustNewConstMetric(tunnelConditionsDesc, prometheus.GaugeValue,
+				float64(counts[status]), conditionType, string(status))
+		}
+	}
+}
+
+func init() {
+	metrics.Registry.MustRegister(cloudflareAPIRequests, cloudflareAPIRequestDuration, cloudflareAPIErrors)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultCloudflareRateLimit is the default number of requests per second sent to the cloudflare API.
+	// Cloudflare allows 1200 requests per 5 minutes, 4 per second: 3 per second leave 300 requests per 5 minutes
+	// for the bursts and for the other clients of the same account.
+	DefaultCloudflareRateLimit = 3
+	// DefaultCloudflareRateBurst is the default number of requests which can be sent at once to the cloudflare API
+	DefaultCloudflareRateBurst = 10
+	// defaultRetryAfter is the delay before retrying a rate limited request when cloudflare does not tell
+	defaultRetryAfter = time.Minute
+)
+
+// RateLimitedError is returned for the requests to the cloudflare API which are rate limited
+type RateLimitedError struct {
+	// RetryAfter is the delay after which requests are accepted again
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return "cloudflare API rate limit reached, retry after " + e.RetryAfter.String()
+}
+
+// RateLimitedTransport is an http.RoundTripper sending the requests of all the cloudflare clients through a single
+// token bucket. Once cloudflare answers 429 Too Many Requests, all the requests fail with a RateLimitedError until
+// the delay of its Retry-After header expires, instead of retrying and extending the rate limit.
+type RateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+// NewRateLimitedTransport returns a RateLimitedTransport sending up to limit requests per second with next,
+// with bursts of up to burst requests. next defaults to http.DefaultTransport.
+func NewRateLimitedTransport(next http.RoundTripper, limit float64, burst int) *RateLimitedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RateLimitedTransport{
+		next:    next,
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if retryAfter := t.pause(); retryAfter > 0 {
+		return nil, &RateLimitedError{RetryAfter: retryAfter}
+	}
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	t.mu.Lock()
+	if until := time.Now().Add(retryAfter); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+	t.mu.Unlock()
+	return nil, &RateLimitedError{RetryAfter: retryAfter}
+}
+
+// NewRateLimitedCloudflareClientFactory returns a CloudflareClientFactory whose clients all send their requests
+// through a single RateLimitedTransport. The rate limiter and the retries of cloudflare-go are disabled: the
+// transport enforces the rate limit, and the rate limited reconciliations are requeued instead of blocking.
+func NewRateLimitedCloudflareClientFactory(limit float64, burst int, opts ...cloudflare.Option) CloudflareClientFactory {
+	httpClient := &http.Client{Transport: NewRateLimitedTransport(nil, limit, burst)}
+	opts = append([]cloudflare.Option{
+		cloudflare.UsingRateLimit(float64(rate.Inf)),
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+	}, opts...)
+	return NewCloudflareClientFactory(httpClient, opts...)
+}
+
+// pause returns how long requests are still paused after a rate limit
+func (t *RateLimitedTransport) pause() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(t.pausedUntil)
+}
+
+// parseRetryAfter parses a Retry-After header holding either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// rateLimitRetryAfter returns the delay after which a reconciliation which failed with err is retried, when err
+// is caused by the cloudflare API rate limit
+func rateLimitRetryAfter(err error) (time.Duration, bool) {
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		return limited.RetryAfter, true
+	}
+	var apiErr *cloudflare.APIRequestError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests {
+		return defaultRetryAfter, true
+	}
+	return 0, false
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+)
+
+// remoteTunnelConfiguration returns the configuration of t to push to cloudflare
+func remoteTunnelConfiguration(t *tunnelv1alpha1.Tunnel) (cloudflareapi.TunnelConfiguration, error) {
+	config := cloudflareapi.TunnelConfiguration{Ingress: []cloudflareapi.TunnelIngressRule{}}
+	for _, ingress := range *tunnelConfig(t).Ingress {
+		rule := cloudflareapi.TunnelIngressRule{Hostname: ingress.HostName}
+		if ingress.Path != nil {
+			rule.Path = *ingress.Path
+		}
+		if ingress.Service != nil {
+			rule.Service = *ingress.Service
+		}
+		if ingress.OriginRequest != nil {
+			originRequest, err := remoteOriginRequest(*ingress.OriginRequest)
+			if err != nil {
+				return config, err
+			}
+			rule.OriginRequest = originRequest
+		}
+		config.Ingress = append(config.Ingress, rule)
+	}
+	return config, nil
+}
+
+// remoteOriginRequest returns the origin settings of a remote ingress rule, whose durations are in seconds
+func remoteOriginRequest(originRequest tunnelv1alpha1.OriginRequestConfig) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	data, err := json.Marshal(originRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	durations := map[string]*time.Duration{
+		"connectTimeout":   originRequest.ConnectTimeout,
+		"tlsTimeout":       originRequest.TLSTimeout,
+		"tcpKeepAlive":     originRequest.TCPKeepAlive,
+		"keepAliveTimeout": originRequest.KeepAliveTimeout,
+	}
+	for key, duration := range durations {
+		if duration != nil {
+			settings[key] = int64(duration.Seconds())
+		}
+	}
+	return settings, nil
+}
+
+// remoteConfigHash returns the hash of the configuration of the tunnel tunnelID
+func remoteConfigHash(tunnelID string, config cloudflareapi.TunnelConfiguration) string {
+	data, _ := json.Marshal(config)
+	h := sha256.New()
+	h.Write([]byte(tunnelID))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// pushRemoteConfig pushes the configuration of t to cloudflare when it changed since it was last pushed.
+// The configuration in cloudflare is read back on the resync period of t, and reverted when it was changed
+// out-of-band.
+func (r *TunnelReconciler) pushRemoteConfig(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel) error {
+	log := ctrllog.FromContext(ctx)
+	config, err := remoteTunnelConfiguration(t)
+	if err != nil {
+		return err
+	}
+	hash := remoteConfigHash(t.Status.TunnelID, config)
+	period := r.resyncPeriod(t)
+	reverted := false
+	if hash == t.Status.RemoteConfigHash {
+		if period <= 0 || r.remoteConfigChecks.dueIn(t.Status.TunnelID) > 0 {
+			return nil
+		}
+		current, err := CF.Client().TunnelConfiguration(ctx, t.Status.TunnelID)
+		if err != nil {
+			return err
+		}
+		if remoteConfigHash(t.Status.TunnelID, current) == hash {
+			r.remoteConfigChecks.schedule(t.Status.TunnelID, period)
+			return nil
+		}
+		log.Info("the configuration of cloudflare tunnel " + t.Status.TunnelID + " was changed out-of-band")
+		reverted = true
+	}
+	log.Info("pushing the configuration of cloudflare tunnel " + t.Status.TunnelID)
+	if err := CF.Client().UpdateTunnelConfiguration(ctx, t.Status.TunnelID, config); err != nil {
+		return err
+	}
+	t.Status.RemoteConfigHash = hash
+	r.remoteConfigChecks.schedule(t.Status.TunnelID, period)
+	if reverted {
+		r.Recorder.Event(t, corev1.EventTypeWarning, "RemoteConfigReverted",
+			"Reverted the configuration of cloudflare tunnel "+t.Status.TunnelID+" changed out-of-band")
+	} else {
+		r.Recorder.Event(t, corev1.EventTypeNormal, "RemoteConfigUpdated", "Pushed the configuration of cloudflare tunnel "+t.Status.TunnelID)
+	}
+	return nil
+}
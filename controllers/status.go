@@ -0,0 +1,200 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+)
+
+// legacyCreatedConditionType is the type of the TunnelCreated condition set by previous versions of the operator
+const legacyCreatedConditionType = "Created"
+
+// setTunnelCondition sets condition in the status of t for its current generation,
+// and returns whether it changed the conditions of t
+func setTunnelCondition(t *tunnelv1alpha1.Tunnel, condition metav1.Condition) bool {
+	condition.ObservedGeneration = t.Generation
+	if !conditionChanged(t.Status.Conditions, condition) {
+		return false
+	}
+	apimeta.SetStatusCondition(&t.Status.Conditions, condition)
+	return true
+}
+
+// readinessConditionTypes returns the types of the conditions which must be True for t to be Ready,
+// the Connected condition only counts when the connections are polled
+func readinessConditionTypes(t *tunnelv1alpha1.Tunnel, connectionsPolled bool) []string {
+	types := []string{
+		tunnelv1alpha1.TunnelConditionCredentialsType,
+		tunnelv1alpha1.TunnelConditionCreatedType,
+		tunnelv1alpha1.TunnelConditionDNSReadyType,
+		tunnelv1alpha1.TunnelConditionConfigSyncedType,
+	}
+	if t.Spec.TunnelID != "" {
+		types = append(types, tunnelv1alpha1.TunnelConditionBoundType)
+	}
+	if t.Spec.Run {
+		types = append(types, tunnelv1alpha1.TunnelConditionConnectorAvailableType)
+		if connectionsPolled {
+			types = append(types, tunnelv1alpha1.TunnelConditionConnectedType)
+		}
+	}
+	return types
+}
+
+// setReadinessConditions summarizes the conditions of t in its Ready and Degraded conditions.
+// t is Ready once all readinessConditionTypes are True, and Degraded as soon as one of them is False
+// or a drift is detected. Conditions which are not known yet only delay readiness.
+func setReadinessConditions(t *tunnelv1alpha1.Tunnel, connectionsPolled bool) {
+	failed := []string{}
+	pending := []string{}
+	for _, conditionType := range readinessConditionTypes(t, connectionsPolled) {
+		condition := apimeta.FindStatusCondition(t.Status.Conditions, conditionType)
+		switch {
+		case condition == nil:
+			pending = append(pending, conditionType+": not reconciled yet")
+		case condition.Status == metav1.ConditionFalse:
+			failed = append(failed, conditionType+": "+condition.Message)
+		case condition.Status != metav1.ConditionTrue:
+			pending = append(pending, conditionType+": "+condition.Message)
+		}
+	}
+	if apimeta.IsStatusConditionTrue(t.Status.Conditions, tunnelv1alpha1.TunnelConditionDriftedType) {
+		drifted := apimeta.FindStatusCondition(t.Status.Conditions, tunnelv1alpha1.TunnelConditionDriftedType)
+		failed = append(failed, tunnelv1alpha1.TunnelConditionDriftedType+": "+drifted.Message)
+	}
+
+	ready := metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionReadyType,
+		Status:  metav1.ConditionTrue,
+		Reason:  tunnelv1alpha1.TunnelConditionReadySuccessReason,
+		Message: "The cloudflare tunnel, its DNS records and its configuration are ready",
+	}
+	degraded := metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionDegradedType,
+		Status:  metav1.ConditionFalse,
+		Reason:  tunnelv1alpha1.TunnelConditionDegradedFalseReason,
+		Message: "No condition is failing",
+	}
+	switch {
+	case len(failed) > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = tunnelv1alpha1.TunnelConditionReadyFailedReason
+		ready.Message = strings.Join(append(failed, pending...), "; ")
+		degraded.Status = metav1.ConditionTrue
+		degraded.Reason = tunnelv1alpha1.TunnelConditionDegradedFailedReason
+		degraded.Message = strings.Join(failed, "; ")
+	case len(pending) > 0:
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = tunnelv1alpha1.TunnelConditionReadyProgressReason
+		ready.Message = strings.Join(pending, "; ")
+	}
+	setTunnelCondition(t, ready)
+	setTunnelCondition(t, degraded)
+}
+
+// observedStatusKey is the context key of the status of the Tunnel being reconciled, as last read or written
+type observedStatusKey struct{}
+
+// withObservedStatus returns a copy of ctx holding the status of t as just read, refreshed by updateStatus
+func withObservedStatus(ctx context.Context, t *tunnelv1alpha1.Tunnel) context.Context {
+	return context.WithValue(ctx, observedStatusKey{}, t.Status.DeepCopy())
+}
+
+// updateStatus updates the status of t, and remembers it as the observed status of the reconciliation
+func (r *TunnelReconciler) updateStatus(ctx context.Context, t *tunnelv1alpha1.Tunnel) error {
+	if err := r.Status().Update(ctx, t); err != nil {
+		return err
+	}
+	if observed, ok := ctx.Value(observedStatusKey{}).(*tunnelv1alpha1.TunnelStatus); ok {
+		t.Status.DeepCopyInto(observed)
+	}
+	return nil
+}
+
+// updateReadiness sets the Ready and Degraded conditions of t and updates its status when it changed
+// since the last time t was read or written in the reconciliation of ctx
+func (r *TunnelReconciler) updateReadiness(ctx context.Context, t *tunnelv1alpha1.Tunnel) error {
+	apimeta.RemoveStatusCondition(&t.Status.Conditions, legacyCreatedConditionType)
+	setReadinessConditions(t, r.ConnectionsPollPeriod > 0)
+	if observed, ok := ctx.Value(observedStatusKey{}).(*tunnelv1alpha1.TunnelStatus); ok &&
+		apiequality.Semantic.DeepEqual(*observed, t.Status) {
+		return nil
+	}
+	if err := r.updateStatus(ctx, t); err != nil {
+		ctrllog.FromContext(ctx).Error(err, "Failed to update Tunnel status")
+		return err
+	}
+	return nil
+}
+
+// connectorCondition returns the ConnectorAvailable condition for the given cloudflared deployment.
+// A deployment without available replicas is reported as progressing until its rollout completes or times out.
+func connectorCondition(dep *appsv1.Deployment) metav1.Condition {
+	condition := metav1.Condition{
+		Type:   tunnelv1alpha1.TunnelConditionConnectorAvailableType,
+		Status: metav1.ConditionTrue,
+		Reason: tunnelv1alpha1.TunnelConditionConnectorAvailableSuccessReason,
+	}
+	replicas := int32(1)
+	if dep.Spec.Replicas != nil {
+		replicas = *dep.Spec.Replicas
+	}
+	if dep.Status.AvailableReplicas > 0 {
+		condition.Message = fmt.Sprintf("%d/%d cloudflared replicas available", dep.Status.AvailableReplicas, replicas)
+		return condition
+	}
+	var progressing *appsv1.DeploymentCondition
+	for i := range dep.Status.Conditions {
+		if dep.Status.Conditions[i].Type == appsv1.DeploymentProgressing {
+			progressing = &dep.Status.Conditions[i]
+		}
+	}
+	if progressing == nil || (progressing.Status == corev1.ConditionTrue && progressing.Reason != "NewReplicaSetAvailable") {
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = tunnelv1alpha1.TunnelConditionConnectorAvailableProgressingReason
+		condition.Message = "Waiting for deployment " + dep.Name + " to roll out"
+		return condition
+	}
+	condition.Status = metav1.ConditionFalse
+	condition.Reason = tunnelv1alpha1.TunnelConditionConnectorAvailableFailedReason
+	condition.Message = "No cloudflared replica of deployment " + dep.Name + " is available"
+	if progressing.Message != "" {
+		condition.Message += ": " + progressing.Message
+	}
+	return condition
+}
+
+// dnsFailedCondition returns a False DNSReady condition with the given message
+func dnsFailedCondition(message string) metav1.Condition {
+	return metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionDNSReadyType,
+		Status:  metav1.ConditionFalse,
+		Reason:  tunnelv1alpha1.TunnelConditionDNSReadyFailedReason,
+		Message: message,
+	}
+}
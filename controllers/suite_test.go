@@ -17,13 +17,18 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -31,15 +36,43 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflarefake"
 	//+kubebuilder:scaffold:imports
 )
 
+const (
+	testAccountID = "test-account"
+	testZoneName  = "example.com"
+	testOwnerID   = "envtest"
+
+	// rateLimitedAccountID is the account served over HTTP through a RateLimitedTransport
+	rateLimitedAccountID = "ratelimited-account"
+)
+
 // These tests use Ginkgo (BDD-style Go testing framework). Refer to
 // http://onsi.github.io/ginkgo/ to learn more about Ginkgo.
 
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var cancelManager context.CancelFunc
+
+// fakeCloudflare is the cloudflare account used by all the controllers under test
+var fakeCloudflare *cloudflarefake.Cloudflare
+var testZoneID string
+
+// cloudflareServer serves the rate limited account to the cloudflare-go clients of newRateLimitedClient
+var cloudflareServer *cloudflarefake.Server
+var newRateLimitedClient CloudflareClientFactory
+
+var _ CloudflareClient = &cloudflarefake.Cloudflare{}
+
+func newFakeCloudflareClient(apiToken, accountID string) (CloudflareClient, error) {
+	if accountID == rateLimitedAccountID {
+		return newRateLimitedClient(apiToken, accountID)
+	}
+	return fakeCloudflare, nil
+}
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -71,10 +104,66 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	Expect(k8sClient).NotTo(BeNil())
 
+	By("starting the controllers against a fake cloudflare account")
+	fakeCloudflare = cloudflarefake.New(testAccountID)
+	testZoneID = fakeCloudflare.AddZone(testZoneName)
+	// tunnels without account reference use the operator environment
+	os.Setenv(accountSecretAPITokenKey, "test-token")
+	os.Setenv(accountSecretAccountIDKey, testAccountID)
+	os.Setenv(accountSecretZoneNameKey, testZoneName)
+	rateLimited := cloudflarefake.New(rateLimitedAccountID)
+	rateLimited.AddZone(testZoneName)
+	cloudflareServer = cloudflarefake.NewServer(rateLimited)
+	newRateLimitedClient = NewRateLimitedCloudflareClientFactory(DefaultCloudflareRateLimit, DefaultCloudflareRateBurst,
+		cloudflare.BaseURL(cloudflareServer.BaseURL()))
+
+	k8sManager, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+	})
+	Expect(err).NotTo(HaveOccurred())
+	err = (&TunnelReconciler{
+		Client:              k8sManager.GetClient(),
+		Scheme:              k8sManager.GetScheme(),
+		NewCloudflareClient: newFakeCloudflareClient,
+		Recorder:            k8sManager.GetEventRecorderFor("tunnel-controller"),
+		// disconnected tunnels are reported quickly, there is no cloudflared connecting in the tests
+		DisconnectedThreshold: 2 * time.Second,
+		ConnectionsPollPeriod: time.Second,
+		DNSOwnerID:            testOwnerID,
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+	err = (&CloudflareAccountReconciler{
+		Client:              k8sManager.GetClient(),
+		Scheme:              k8sManager.GetScheme(),
+		NewCloudflareClient: newFakeCloudflareClient,
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+	err = (&ClusterCloudflareAccountReconciler{
+		Client:              k8sManager.GetClient(),
+		Scheme:              k8sManager.GetScheme(),
+		NewCloudflareClient: newFakeCloudflareClient,
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	var ctx context.Context
+	ctx, cancelManager = context.WithCancel(context.Background())
+	go func() {
+		defer GinkgoRecover()
+		err := k8sManager.Start(ctx)
+		Expect(err).NotTo(HaveOccurred())
+	}()
+
 }, 60)
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if cancelManager != nil {
+		cancelManager()
+	}
+	if cloudflareServer != nil {
+		cloudflareServer.Close()
+	}
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
@@ -18,10 +18,16 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	"gopkg.in/yaml.v3"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -31,11 +37,15 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
 )
@@ -44,20 +54,65 @@ import (
 type TunnelReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// NewCloudflareClient creates the clients used to reach cloudflare, defaults to NewCloudflareClient
+	NewCloudflareClient CloudflareClientFactory
+
+	// Recorder emits events about the actions taken on the cloudflare side
+	Recorder record.EventRecorder
+
+	// ResyncPeriod is the default period after which tunnels are verified against cloudflare, zero disables it
+	ResyncPeriod time.Duration
+
+	// ConnectionsPollPeriod is the period at which the connections of tunnels are polled, zero disables it
+	ConnectionsPollPeriod time.Duration
+
+	// DisconnectedThreshold is the time after which a tunnel without connections is reported disconnected,
+	// defaults to DefaultDisconnectedThreshold
+	DisconnectedThreshold time.Duration
+
+	// CloudflareCacheTTL is the time during which the tunnels and DNS records read from cloudflare are reused
+	// by the following reconciliations, zero disables caching
+	CloudflareCacheTTL time.Duration
+
+	// DNSOwnerID identifies the operator instance in the TXT records claiming the CNAME records it manages,
+	// defaults to DefaultDNSOwnerID
+	DNSOwnerID string
+
+	// CloudflaredImage is the cloudflared image run by the Tunnels with run: true,
+	// defaults to tunnelv1alpha1.DefaultCloudflaredImage
+	CloudflaredImage string
+
+	clients            cloudflareClients
+	connectionPolls    pollSchedule
+	remoteConfigChecks pollSchedule
 }
 
 const tunnelFinalizer = "tunnel.zeeweb.xyz/finalizer"
 
+// accountSecretIndexKey indexes Tunnels by the name of their account secret
+const accountSecretIndexKey = ".spec.accountSecret.name"
+
+// adoptSecretIndexKey indexes Tunnels by the name of their adoption secret
+const adoptSecretIndexKey = ".spec.adopt.secretName"
+
+// accountRefIndexKey indexes Tunnels by their account reference, formatted as kind/namespace/name
+const accountRefIndexKey = ".spec.accountRef"
+
 //+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=tunnels,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=tunnels/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=tunnels/finalizers,verbs=update
+//+kubebuilder:rbac:groups=tunnel.zeeweb.xyz,resources=cloudflareaccounts;clustercloudflareaccounts,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
-func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, reconcileErr error) {
 	log := ctrllog.FromContext(ctx)
 	log.Info("reconciling")
 
@@ -77,52 +132,133 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, err
 	}
 
-	CF := Cloudflare{ctx: ctx, log: log}
-	api, err := CF.Api()
-	// api, err := r.cloudflareApi()
+	// Check if the Tunnel instance is marked to be deleted, which is
+	// indicated by the deletion timestamp being set.
+	isToBeDeleted := tunnel.GetDeletionTimestamp() != nil
+	if isToBeDeleted && tunnel.Status.TunnelID == "" {
+		// nothing was created in cloudflare, no need for credentials to clean up
+		if controllerutil.ContainsFinalizer(tunnel, tunnelFinalizer) {
+			controllerutil.RemoveFinalizer(tunnel, tunnelFinalizer)
+			err := r.Update(ctx, tunnel)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// every reconciliation ends with the Ready and Degraded conditions summarizing the other conditions,
+	// and the cloudflare failures are reported in events. Rate limited reconciliations are requeued.
+	ctx = withObservedStatus(ctx, tunnel)
+	defer func() {
+		var apiErr *cloudflareAPIError
+		if retryAfter, limited := rateLimitRetryAfter(reconcileErr); limited {
+			// the reconciliation is retried once the rate limit expires instead of backing off from now on
+			log.Info("cloudflare API rate limit reached", "retryAfter", retryAfter)
+			r.Recorder.Event(tunnel, corev1.EventTypeWarning, "CloudflareRateLimited",
+				"Cloudflare API rate limit reached, retrying in "+retryAfter.String())
+			result, reconcileErr = ctrl.Result{RequeueAfter: retryAfter}, nil
+		} else if errors.As(reconcileErr, &apiErr) {
+			r.Recorder.Event(tunnel, corev1.EventTypeWarning, "CloudflareAPIError",
+				"Cloudflare "+apiErr.Operation+" failed: "+apiErr.Error())
+		}
+		if isToBeDeleted {
+			return
+		}
+		if err := r.updateReadiness(ctx, tunnel); err != nil && reconcileErr == nil {
+			reconcileErr = err
+		}
+	}()
+
+	creds, err := r.credentialsForTunnel(ctx, tunnel)
+	if err != nil {
+		var credsErr *credentialsError
+		if !errors.As(err, &credsErr) {
+			log.Error(err, "Failed to retrieve cloudflare credentials")
+			return ctrl.Result{}, err
+		}
+		log.Error(err, "invalid cloudflare credentials")
+		setTunnelCondition(tunnel,
+			metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionCredentialsType,
+				Status:  metav1.ConditionFalse,
+				Reason:  credsErr.Reason,
+				Message: credsErr.Message,
+			})
+		// the account secret is watched: the tunnel is reconciled again once it gets fixed
+		err := r.updateStatus(ctx, tunnel)
+		return ctrl.Result{}, err
+	}
+	credentialsResolved := metav1.Condition{
+		Type:    tunnelv1alpha1.TunnelConditionCredentialsType,
+		Status:  metav1.ConditionTrue,
+		Reason:  tunnelv1alpha1.TunnelConditionCredentialsSuccessReason,
+		Message: "Cloudflare credentials resolved for account " + creds.AccountID,
+	}
+	if setTunnelCondition(tunnel, credentialsResolved) {
+		if err := r.updateStatus(ctx, tunnel); err != nil {
+			log.Error(err, "Failed to update Tunnel status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	CF, err := r.clients.Get(ctx, creds, r.NewCloudflareClient, r.CloudflareCacheTTL)
 	if err != nil {
 		log.Error(err, "could not initiate cloudflare client")
 		return ctrl.Result{}, err
 	}
+	api := CF.Client()
 
-	// Check if the Tunnel instance is marked to be deleted, which is
-	// indicated by the deletion timestamp being set.
-	isToBeDeleted := tunnel.GetDeletionTimestamp() != nil
 	if isToBeDeleted {
 		if controllerutil.ContainsFinalizer(tunnel, tunnelFinalizer) {
-			if tunnel.Status.TunnelID == "" {
-				controllerutil.RemoveFinalizer(tunnel, tunnelFinalizer)
-				err := r.Update(ctx, tunnel)
-				if err != nil {
-					return ctrl.Result{}, err
-				}
-			}
 			// Run finalization logic for Tunnel. If the
 			// finalization logic fails, don't remove the finalizer so
 			// that we can retry during the next reconciliation.
 			for _, hostname := range tunnel.Status.IngressHostnames {
-				if err := CF.DeleteDNSRecords("CNAME", hostname); err != nil {
+				zoneID, err := hostnameZoneID(ctx, CF, tunnel, hostname)
+				if err != nil {
+					return reconcile.Result{}, err
+				}
+				if zoneID == "" {
+					continue
+				}
+				deleted, err := CF.DeleteTunnelDNSRecords(ctx, zoneID, hostname, tunnelDNSOwner(r.DNSOwnerID, tunnel))
+				if err := r.recordDNSRecordsDeleted(tunnel, hostname, deleted, err); err != nil {
 					return reconcile.Result{}, err
 				}
 			}
 			if tunnel.Spec.Run {
-				dep := r.deploymentForTunnelRun(tunnel)
-				err := r.Get(ctx, types.NamespacedName{Name: dep.Name, Namespace: dep.Namespace}, dep)
+				dep := &appsv1.Deployment{}
+				err := r.Get(ctx, types.NamespacedName{Name: tunnel.Name, Namespace: tunnel.Namespace}, dep)
 				if err != nil && !apierrors.IsNotFound(err) {
 					return reconcile.Result{}, err
 				} else if err == nil {
+					// scaled down with the fields it applies, keeping the rollout of the running pods
+					scaled, err := r.deploymentForTunnelRun(tunnel, dep.Spec.Template.Annotations[tunnelv1alpha1.TunnelConfigHashAnnotation])
+					if err != nil {
+						return reconcile.Result{}, err
+					}
 					var zero int32 = 0
-					dep.Spec.Replicas = &zero
-					if err := r.Update(ctx, dep); err != nil {
+					scaled.Spec.Replicas = &zero
+					if err := r.apply(ctx, scaled); err != nil {
 						return reconcile.Result{}, err
 					}
 				}
 			}
-			log.Info("deleting tunnel " + tunnel.Status.TunnelID)
-			if err := api.DeleteArgoTunnel(ctx, api.AccountID, tunnel.Status.TunnelID); err != nil {
-				return ctrl.Result{}, err
+			if tunnel.RetainsTunnel() {
+				log.Info("retaining adopted tunnel " + tunnel.Status.TunnelID)
+				r.Recorder.Event(tunnel, corev1.EventTypeNormal, "TunnelRetained", "Left adopted cloudflare tunnel "+tunnel.Status.TunnelID+" in place")
+			} else {
+				log.Info("deleting tunnel " + tunnel.Status.TunnelID)
+				if err := api.DeleteArgoTunnel(ctx, tunnel.Status.TunnelID); err != nil && !isCloudflareNotFound(err) {
+					return ctrl.Result{}, err
+				}
+				r.Recorder.Event(tunnel, corev1.EventTypeNormal, "TunnelDeleted", "Deleted cloudflare tunnel "+tunnel.Status.TunnelID)
 			}
 
+			r.connectionPolls.forget(tunnel.Status.TunnelID)
+			r.remoteConfigChecks.forget(tunnel.Status.TunnelID)
+
 			// Remove tunnelFinalizer. Once all finalizers have been
 			// removed, the object will be deleted.
 			controllerutil.RemoveFinalizer(tunnel, tunnelFinalizer)
@@ -143,42 +279,101 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}
 
+	if tunnel.Status.TunnelID != "" && tunnel.Status.AccountID != "" && tunnel.Status.AccountID != api.AccountID() {
+		// the tunnel is never looked up, recreated or replaced in another account than its own
+		log.Info("cloudflare tunnel " + tunnel.Status.TunnelID + " belongs to account " + tunnel.Status.AccountID +
+			", not to account " + api.AccountID())
+		if setTunnelCondition(tunnel, metav1.Condition{
+			Type:   tunnelv1alpha1.TunnelConditionCreatedType,
+			Status: metav1.ConditionFalse,
+			Reason: tunnelv1alpha1.TunnelConditionCreatedAccountChangedReason,
+			Message: "Cloudflare tunnel " + tunnel.Status.TunnelID + " belongs to account " + tunnel.Status.AccountID +
+				" but the credentials are for account " + api.AccountID() + ", restore the credentials or recreate the Tunnel",
+		}) {
+			if err := r.updateStatus(ctx, tunnel); err != nil {
+				log.Error(err, "Failed to update Tunnel status")
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
 	// Tunnel creation
 	log.Info("looking up tunnel " + tunnel.Spec.Name)
-	cfTunnels, err := api.ArgoTunnels(ctx, api.AccountID)
+	cfTunnels, err := api.ArgoTunnels(ctx)
 	if err != nil {
 		log.Error(err, "Failed to retrieve the list of tunnels from Cloudflare")
 		return reconcile.Result{}, err
 	}
 	exists := false
-	for _, t := range cfTunnels {
-		if t.Name == tunnel.Spec.Name && t.DeletedAt == nil {
-			exists = true
+	var existing cloudflare.ArgoTunnel
+	if tunnel.Spec.TunnelID != "" {
+		// bound tunnels are looked up by ID and never recreated
+		condition, bound := tunnelBinding(tunnel, cfTunnels)
+		if setTunnelCondition(tunnel, condition) {
+			if err := r.updateStatus(ctx, tunnel); err != nil {
+				log.Error(err, "Failed to update Tunnel status")
+				return ctrl.Result{}, err
+			}
+		}
+		if bound == nil {
+			log.Info("cloudflare tunnel drifted: " + condition.Message)
+			return ctrl.Result{RequeueAfter: r.resyncPeriod(tunnel)}, nil
+		}
+		exists = true
+		existing = *bound
+	} else {
+		if apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionBoundType) != nil {
+			apimeta.RemoveStatusCondition(&tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionBoundType)
+			err := r.updateStatus(ctx, tunnel)
+			return ctrl.Result{}, err
+		}
+		if tunnel.Status.TunnelID != "" && !isTunnelLive(cfTunnels, tunnel.Status.TunnelID) {
+			// the listing may be truncated or cached: the deletion is confirmed before recreating the tunnel
+			cfTunnel, err := api.ArgoTunnel(ctx, tunnel.Status.TunnelID)
+			if err != nil && !isCloudflareNotFound(err) {
+				log.Error(err, "Failed to get cloudflare tunnel "+tunnel.Status.TunnelID)
+				return ctrl.Result{}, err
+			}
+			if err != nil || cfTunnel.DeletedAt != nil {
+				return r.recreateTunnel(ctx, CF, tunnel)
+			}
+			cfTunnels = append(cfTunnels, cfTunnel)
+		}
+		for _, t := range cfTunnels {
+			if t.Name == tunnel.Spec.Name && t.DeletedAt == nil {
+				exists = true
+				existing = t
+			}
 		}
 	}
 	if !exists {
-		secretB64 := CF.NewTunnelSecretB64()
+		secretB64, err := newTunnelSecretB64()
+		if err != nil {
+			log.Error(err, "Failed to generate tunnel secret")
+			return ctrl.Result{}, err
+		}
 		log.Info("creating cloudflare tunnel " + tunnel.Spec.Name)
-		cfTunnel, err := api.CreateArgoTunnel(ctx, api.AccountID, tunnel.Spec.Name, secretB64)
+		cfTunnel, err := api.CreateArgoTunnel(ctx, tunnel.Spec.Name, secretB64)
 		if err != nil {
 			log.Error(err, "Failed to create cloudflare tunnel")
-			apimeta.SetStatusCondition(&tunnel.Status.Conditions,
+			setTunnelCondition(tunnel,
 				metav1.Condition{
 					Type:    tunnelv1alpha1.TunnelConditionCreatedType,
 					Status:  metav1.ConditionFalse,
 					Reason:  tunnelv1alpha1.TunnelConditionCreatedFailedReason,
 					Message: "Cloudflare tunnel creation failed: " + err.Error(),
 				})
-			errStatus := r.Status().Update(ctx, tunnel)
+			errStatus := r.updateStatus(ctx, tunnel)
 			if errStatus != nil {
 				log.Error(err, "Failed to update Tunnel status")
 				return ctrl.Result{}, errStatus
 			}
 			return ctrl.Result{}, err
 		}
-		tunnel.Status.AccountID = api.AccountID
+		tunnel.Status.AccountID = api.AccountID()
 		tunnel.Status.TunnelID = cfTunnel.ID
-		apimeta.SetStatusCondition(&tunnel.Status.Conditions,
+		setTunnelCondition(tunnel,
 			metav1.Condition{
 				Type:    tunnelv1alpha1.TunnelConditionCreatedType,
 				Status:  metav1.ConditionTrue,
@@ -186,46 +381,136 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 				Message: "Cloudflare tunnel created successfully with ID " + cfTunnel.ID,
 			})
 		s := r.newTunnelSecret(tunnel, secretB64)
-		if err := r.Create(ctx, s); err != nil {
+		// the secret is created rather than applied, so that an existing secret of the same name is never overwritten
+		if err := r.Create(ctx, s, fieldOwner); err != nil {
 			log.Error(err, "Failed to create tunnel secret")
 			log.Info("deleting cloudflare tunnel " + tunnel.Status.TunnelID)
-			_ = api.DeleteArgoTunnel(ctx, api.AccountID, tunnel.Status.TunnelID)
+			_ = api.DeleteArgoTunnel(ctx, tunnel.Status.TunnelID)
 			return ctrl.Result{Requeue: true}, err
 		}
-		if err := r.Status().Update(ctx, tunnel); err != nil {
+		if err := r.updateStatus(ctx, tunnel); err != nil {
 			log.Error(err, "Failed to update Tunnel status")
 			log.Info("deleting cloudflare tunnel " + tunnel.Status.TunnelID)
-			_ = api.DeleteArgoTunnel(ctx, api.AccountID, tunnel.Status.TunnelID)
+			_ = api.DeleteArgoTunnel(ctx, tunnel.Status.TunnelID)
 			return ctrl.Result{Requeue: true}, err
 		}
+		r.Recorder.Event(tunnel, corev1.EventTypeNormal, "TunnelCreated", "Created cloudflare tunnel "+cfTunnel.ID)
+		r.Recorder.Event(tunnel, corev1.EventTypeNormal, "SecretCreated", "Created tunnel secret "+s.Name)
 		return ctrl.Result{}, err
 	}
 
 	tunnelID := tunnel.Status.TunnelID
 	// our tunnel already exists but was not created by this resource
 	// or the id is not yet filled in the conditions
-	if tunnelID == "" {
-		apimeta.SetStatusCondition(&tunnel.Status.Conditions,
+	if tunnelID == "" || (tunnel.Spec.TunnelID != "" && tunnelID != existing.ID) {
+		if tunnel.Spec.Adopt != nil {
+			return r.adoptTunnel(ctx, tunnel, existing, api.AccountID())
+		}
+		setTunnelCondition(tunnel,
 			metav1.Condition{
 				Type:    tunnelv1alpha1.TunnelConditionCreatedType,
 				Status:  metav1.ConditionFalse,
-				Reason:  tunnelv1alpha1.TunnelConditionCreatedFailedReason,
-				Message: "Cloudflare tunnel already exists with name " + tunnel.Spec.Name,
+				Reason:  tunnelv1alpha1.TunnelConditionCreatedExistsReason,
+				Message: "Cloudflare tunnel " + existing.ID + " already exists with name " + tunnel.Spec.Name + ", set spec.adopt to manage it",
 			})
-		err := r.Status().Update(ctx, tunnel)
+		err := r.updateStatus(ctx, tunnel)
 		return ctrl.Result{}, err
 	}
 
+	if rotation := tunnel.Annotations[tunnelv1alpha1.TunnelRotateSecretAnnotation]; rotation != "" && rotation != tunnel.Status.SecretRotation {
+		return r.rotateTunnelSecret(ctx, CF, tunnel, rotation)
+	}
+
+	unresolved := []string{}
+	conflicts := []string{}
+	owner := tunnelDNSOwner(r.DNSOwnerID, tunnel)
 	if tunnel.Spec.Ingress != nil {
 		// Create missing DNS records
 		for _, ingress := range *tunnel.Spec.Ingress {
-			if err := CF.CreateTunnelDNSRecord(ingress.HostName, tunnel); err != nil {
+			if ingress.HostName == "" || dnsSkipped(ingress) {
+				continue
+			}
+			zone, found, err := CF.ResolveZone(ctx, ingress.HostName, ingress.Zone)
+			if err != nil {
+				log.Error(err, "failed to resolve the zone of "+ingress.HostName)
+				setTunnelCondition(tunnel, dnsFailedCondition("Failed to resolve the zone of "+ingress.HostName+": "+err.Error()))
+				return reconcile.Result{}, err
+			}
+			if !found {
+				unresolved = append(unresolved, ingress.HostName)
+				continue
+			}
+			desired := tunnelDNSRecord(tunnel, ingress.HostName, ingress.DNS)
+			action, current, err := CF.EnsureTunnelDNSRecord(ctx, zone.ID, desired, owner)
+			switch action {
+			case dnsRecordCreated:
+				r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DNSRecordCreated",
+					"Created CNAME record "+ingress.HostName+" pointing to cloudflare tunnel "+tunnel.Status.TunnelID)
+			case dnsRecordUpdated:
+				r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DNSRecordUpdated",
+					"Updated the settings of CNAME record "+ingress.HostName)
+			}
+			if err != nil {
+				log.Error(err, "failed to create CNAME record "+ingress.HostName)
+				setTunnelCondition(tunnel, dnsFailedCondition("Failed to create CNAME record "+ingress.HostName+": "+err.Error()))
 				return reconcile.Result{}, err
 			}
 			recordedInStatus := inSlice(ingress.HostName, tunnel.Status.IngressHostnames)
+			switch action {
+			case dnsRecordMismatch:
+				targetID := tunnelIDFromTarget(current.Content)
+				if recordedInStatus && targetID == "" {
+					// a record of the Tunnel pointed elsewhere by hand is reported by the drift detection,
+					// the records pointing at another tunnel are always repaired
+					continue
+				}
+				if err := CF.CorrectTunnelDNSRecord(ctx, zone.ID, current, desired, owner); err != nil {
+					log.Error(err, "failed to repair CNAME record "+ingress.HostName)
+					setTunnelCondition(tunnel, dnsFailedCondition("Failed to repair CNAME record "+ingress.HostName+": "+err.Error()))
+					return reconcile.Result{}, err
+				}
+				from := current.Content
+				if targetID != "" && !isTunnelLive(cfTunnels, targetID) {
+					from = "deleted tunnel " + targetID
+				} else if targetID != "" {
+					from = "cloudflare tunnel " + targetID
+				}
+				r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DNSRecordRepaired",
+					"Repointed CNAME record "+ingress.HostName+" from "+from+" to cloudflare tunnel "+tunnel.Status.TunnelID)
+			case dnsRecordNotOwned:
+				detail := "not owned by the Tunnel"
+				if current != nil {
+					detail = "targets " + current.Content + ", " + detail
+				}
+				conflicts = append(conflicts, ingress.HostName+" ("+detail+")")
+				if recordedInStatus {
+					// the record is owned elsewhere: it must never be deleted with this Tunnel
+					tunnel.Status.IngressHostnames = removeFromSlice(ingress.HostName, tunnel.Status.IngressHostnames)
+					removeRecordedZone(tunnel, ingress.HostName)
+					err := r.updateStatus(ctx, tunnel)
+					return ctrl.Result{}, err
+				}
+				continue
+			}
 			if !recordedInStatus {
 				tunnel.Status.IngressHostnames = append(tunnel.Status.IngressHostnames, ingress.HostName)
-				err := r.Status().Update(ctx, tunnel)
+				setRecordedZone(tunnel, ingress.HostName, zone)
+				err := r.updateStatus(ctx, tunnel)
+				return ctrl.Result{}, err
+			}
+			if previousZoneID := recordedZoneID(tunnel, ingress.HostName); previousZoneID != zone.ID {
+				// the record moved to another zone, or its zone was not recorded by a previous version
+				if previousZoneID != "" {
+					deleted, err := CF.DeleteTunnelDNSRecords(ctx, previousZoneID, ingress.HostName, owner)
+					if err := r.recordDNSRecordsDeleted(tunnel, ingress.HostName, deleted, err); err != nil {
+						log.Error(err, "failed to delete CNAME record "+ingress.HostName+" from its previous zone")
+						setTunnelCondition(tunnel, dnsFailedCondition("Failed to delete CNAME record "+ingress.HostName+
+							" from its previous zone: "+err.Error()))
+						return reconcile.Result{}, err
+					}
+				}
+				setRecordedZone(tunnel, ingress.HostName, zone)
+				err := r.updateStatus(ctx, tunnel)
 				return ctrl.Result{}, err
 			}
 		}
@@ -233,16 +518,30 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		hostnames := []string{}
 		for _, statusHostname := range tunnel.Status.IngressHostnames {
 			found := false
+			skipped := false
 			for _, ingress := range *tunnel.Spec.Ingress {
 				if statusHostname == ingress.HostName {
 					found = true
+					skipped = dnsSkipped(ingress)
 					break
 				}
 			}
-			if !found {
-				if err := CF.DeleteDNSRecords("CNAME", statusHostname); err != nil {
+			if skipped {
+				// the record is now managed elsewhere: it is forgotten rather than deleted
+				removeRecordedZone(tunnel, statusHostname)
+				updatedHostnames = true
+			} else if !found {
+				zoneID, err := hostnameZoneID(ctx, CF, tunnel, statusHostname)
+				deleted := 0
+				if err == nil && zoneID != "" {
+					deleted, err = CF.DeleteTunnelDNSRecords(ctx, zoneID, statusHostname, owner)
+				}
+				if err := r.recordDNSRecordsDeleted(tunnel, statusHostname, deleted, err); err != nil {
+					log.Error(err, "failed to delete CNAME record "+statusHostname)
+					setTunnelCondition(tunnel, dnsFailedCondition("Failed to delete CNAME record "+statusHostname+": "+err.Error()))
 					return reconcile.Result{}, err
 				}
+				removeRecordedZone(tunnel, statusHostname)
 				updatedHostnames = true
 			} else {
 				hostnames = append(hostnames, statusHostname)
@@ -250,53 +549,145 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 		if updatedHostnames {
 			tunnel.Status.IngressHostnames = hostnames
-			err := r.Status().Update(ctx, tunnel)
+			err := r.updateStatus(ctx, tunnel)
 			return reconcile.Result{}, err
 		}
-		if err := r.updateTunnelSecretConfig(ctx, tunnel); err != nil {
+	}
+	if len(conflicts) > 0 {
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionDNSConflictType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionDNSConflictDetectedReason,
+			Message: "CNAME records not owned by the tunnel: " + strings.Join(conflicts, ", "),
+		})
+	} else {
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionDNSConflictType,
+			Status:  metav1.ConditionFalse,
+			Reason:  tunnelv1alpha1.TunnelConditionDNSConflictNoneReason,
+			Message: "No CNAME record of the tunnel is owned elsewhere",
+		})
+	}
+	tunnel.Status.UnresolvedHostnames = nil
+	if len(unresolved) > 0 {
+		tunnel.Status.UnresolvedHostnames = unresolved
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionDNSReadyType,
+			Status:  metav1.ConditionFalse,
+			Reason:  tunnelv1alpha1.TunnelConditionDNSReadyNoZoneReason,
+			Message: "No zone accessible with the cloudflare credentials holds " + strings.Join(unresolved, ", "),
+		})
+	} else if len(conflicts) > 0 {
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionDNSReadyType,
+			Status:  metav1.ConditionFalse,
+			Reason:  tunnelv1alpha1.TunnelConditionDNSReadyConflictReason,
+			Message: "CNAME records of " + strconv.Itoa(len(conflicts)) + " hostnames point elsewhere",
+		})
+	} else {
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionDNSReadyType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionDNSReadySuccessReason,
+			Message: strconv.Itoa(len(tunnel.Status.IngressHostnames)) + " CNAME records point to the tunnel",
+		})
+	}
+
+	configHash, err := r.updateTunnelSecretConfig(ctx, tunnel)
+	if err != nil {
+		log.Error(err, "failed to update the tunnel configuration")
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionConfigSyncedType,
+			Status:  metav1.ConditionFalse,
+			Reason:  tunnelv1alpha1.TunnelConditionConfigSyncedFailedReason,
+			Message: "Failed to write the tunnel configuration: " + err.Error(),
+		})
+		return reconcile.Result{}, err
+	}
+	if tunnel.IsRemotelyConfigured() || tunnel.Status.RemoteConfigHash != "" {
+		// a remotely managed tunnel cannot be managed locally again: its configuration is still pushed
+		if err := r.pushRemoteConfig(ctx, CF, tunnel); err != nil {
+			log.Error(err, "failed to push the tunnel configuration to cloudflare")
+			setTunnelCondition(tunnel, metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionConfigSyncedType,
+				Status:  metav1.ConditionFalse,
+				Reason:  tunnelv1alpha1.TunnelConditionConfigSyncedRemoteFailedReason,
+				Message: "Failed to push the tunnel configuration to cloudflare: " + err.Error(),
+			})
 			return reconcile.Result{}, err
 		}
+		if tunnel.IsRemotelyConfigured() {
+			setTunnelCondition(tunnel, metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionConfigSyncedType,
+				Status:  metav1.ConditionTrue,
+				Reason:  tunnelv1alpha1.TunnelConditionConfigSyncedRemoteSuccessReason,
+				Message: "The tunnel configuration is pushed to cloudflare",
+			})
+		} else if setTunnelCondition(tunnel, metav1.Condition{
+			Type:   tunnelv1alpha1.TunnelConditionConfigSyncedType,
+			Status: metav1.ConditionFalse,
+			Reason: tunnelv1alpha1.TunnelConditionConfigSyncedRemoteActiveReason,
+			Message: "The tunnel is remotely managed, cloudflared keeps using the configuration pushed to cloudflare: " +
+				"set configSource back to cloudflare, or recreate the Tunnel to configure it locally",
+		}) {
+			r.Recorder.Event(tunnel, corev1.EventTypeWarning, "RemoteConfigActive",
+				"Cloudflare tunnel "+tunnel.Status.TunnelID+" is remotely managed and cannot be configured locally again")
+		}
+	} else {
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionConfigSyncedType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionConfigSyncedSuccessReason,
+			Message: "The tunnel configuration is written in secret " + tunnel.BaseTunnelSecret().Name,
+		})
 	}
 
+	if err := r.checkDrift(ctx, CF, tunnel); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	pollAfter := r.pollConnections(ctx, CF, tunnel)
+
 	if tunnel.Spec.Run {
-		// Set the deploymentSpec in the Tunnel resource so it gets easy to be updated
-		// Not sure if that's really a good idea..
-		if tunnel.Spec.DeploymentSpec == nil {
-			spec := tunnel.DefaultDeploymentSpec()
-			tunnel.Spec.DeploymentSpec = &spec
-			err := r.Update(ctx, tunnel)
-			return reconcile.Result{}, err
-		}
 		found := &appsv1.Deployment{}
 		err = r.Get(ctx, req.NamespacedName, found)
-		if err != nil && apierrors.IsNotFound(err) {
-			// Define a new deployment
-			dep := r.deploymentForTunnelRun(tunnel)
-			log.Info("Creating a new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
-			err = r.Create(ctx, dep)
-			if err != nil {
-				log.Error(err, "Failed to create new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
-				return ctrl.Result{}, err
-			}
-			// Deployment created successfully - return and requeue
-			return ctrl.Result{Requeue: true}, nil
-		} else if err != nil {
+		exists := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
 			log.Error(err, "Failed to get Deployment")
 			return ctrl.Result{}, err
 		}
-
-		if found.Labels["tunnel-id"] != tunnel.Status.TunnelID {
-			dep := r.deploymentForTunnelRun(tunnel)
-			err := r.Update(ctx, dep)
-			if err != nil {
-				log.Error(err, "failed to update Deployment", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
+		if exists && found.Labels["tunnel-id"] != tunnel.Status.TunnelID {
+			// the tunnel ID is part of the immutable deployment selector:
+			// the deployment of a recreated tunnel is replaced
+			log.Info("deleting deployment of a previous tunnel", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
+			err := r.Delete(ctx, found, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrors.IsNotFound(err) {
+				log.Error(err, "failed to delete Deployment", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
 				return ctrl.Result{}, err
 			}
-			// Ask to requeue after 1 minute in order to give enough time for the
-			// pods be created on the cluster side and the operand be able
-			// to do the next update step accurately.
-			return ctrl.Result{RequeueAfter: time.Minute}, nil
+			r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DeploymentDeleted",
+				"Deleted deployment "+found.Name+" of previous cloudflare tunnel "+found.Labels["tunnel-id"])
+			return ctrl.Result{Requeue: true}, nil
+		}
+		dep, err := r.deploymentForTunnelRun(tunnel, configHash)
+		if err != nil {
+			log.Error(err, "Failed to compute the Deployment")
+			return ctrl.Result{}, err
+		}
+		if err := r.apply(ctx, dep); err != nil {
+			log.Error(err, "Failed to apply Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+			return ctrl.Result{}, err
+		}
+		if !exists {
+			r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DeploymentCreated", "Created deployment "+dep.Name+" running cloudflared")
+			// Deployment created successfully - return and requeue
+			return ctrl.Result{Requeue: true}, nil
+		}
+		if dep.Generation != found.Generation {
+			r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DeploymentUpdated", "Updated deployment "+dep.Name+" running cloudflared")
 		}
+		found = dep
+		setTunnelCondition(tunnel, connectorCondition(found))
 	} else {
 		found := &appsv1.Deployment{}
 		err = r.Get(ctx, req.NamespacedName, found)
@@ -309,13 +700,162 @@ func (r *TunnelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 			if err = r.Delete(ctx, found); err != nil {
 				return reconcile.Result{}, err
 			}
+			r.Recorder.Event(tunnel, corev1.EventTypeNormal, "DeploymentDeleted", "Deleted deployment "+found.Name+", spec.run is false")
 		}
+		setTunnelCondition(tunnel, metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionConnectorAvailableType,
+			Status:  metav1.ConditionUnknown,
+			Reason:  tunnelv1alpha1.TunnelConditionConnectorAvailableNotRunReason,
+			Message: "cloudflared is not run by the operator, spec.run is false",
+		})
 	}
 
 	log.Info("nothing to do")
+	tunnel.Status.ObservedGeneration = tunnel.Generation
+	return ctrl.Result{RequeueAfter: minRequeueAfter(r.resyncPeriod(tunnel), pollAfter)}, nil
+}
+
+// isTunnelLive returns whether the tunnel with the given ID exists and is not deleted
+func isTunnelLive(cfTunnels []cloudflare.ArgoTunnel, tunnelID string) bool {
+	for _, t := range cfTunnels {
+		if t.ID == tunnelID && t.DeletedAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// recreateTunnel replaces the tunnel of t after it was deleted out-of-band: a new tunnel is created with new
+// credentials in the tunnel secret, and the CNAME records of the deleted tunnel are repointed to it.
+// The deployment is replaced on the next reconciliation since its tunnel-id label no longer matches.
+func (r *TunnelReconciler) recreateTunnel(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	api := CF.Client()
+	oldTunnelID := t.Status.TunnelID
+
+	secretB64, err := newTunnelSecretB64()
+	if err != nil {
+		log.Error(err, "Failed to generate tunnel secret")
+		return ctrl.Result{}, err
+	}
+	log.Info("recreating cloudflare tunnel " + t.Spec.Name + ", " + oldTunnelID + " was deleted out-of-band")
+	cfTunnel, err := api.CreateArgoTunnel(ctx, t.Spec.Name, secretB64)
+	if err != nil {
+		log.Error(err, "Failed to recreate cloudflare tunnel")
+		setTunnelCondition(t,
+			metav1.Condition{
+				Type:    tunnelv1alpha1.TunnelConditionCreatedType,
+				Status:  metav1.ConditionFalse,
+				Reason:  tunnelv1alpha1.TunnelConditionCreatedFailedReason,
+				Message: "Cloudflare tunnel " + oldTunnelID + " was deleted and its recreation failed: " + err.Error(),
+			})
+		if errStatus := r.updateStatus(ctx, t); errStatus != nil {
+			log.Error(errStatus, "Failed to update Tunnel status")
+			return ctrl.Result{}, errStatus
+		}
+		return ctrl.Result{}, err
+	}
+
+	t.Status.AccountID = api.AccountID()
+	t.Status.TunnelID = cfTunnel.ID
+	t.Status.Adopted = false
+	if err := r.writeTunnelSecret(ctx, t, secretB64); err != nil {
+		log.Error(err, "Failed to write tunnel secret")
+		log.Info("deleting cloudflare tunnel " + cfTunnel.ID)
+		_ = api.DeleteArgoTunnel(ctx, cfTunnel.ID)
+		return ctrl.Result{}, err
+	}
+	for _, hostname := range t.Status.IngressHostnames {
+		zoneID, err := hostnameZoneID(ctx, CF, t, hostname)
+		if err == nil && zoneID != "" {
+			err = CF.RepointTunnelDNSRecords(ctx, zoneID, hostname, oldTunnelID, cfTunnel.ID, tunnelDNSOwner(r.DNSOwnerID, t))
+		}
+		if err != nil {
+			log.Info("deleting cloudflare tunnel " + cfTunnel.ID)
+			_ = api.DeleteArgoTunnel(ctx, cfTunnel.ID)
+			return ctrl.Result{}, err
+		}
+	}
+	setTunnelCondition(t,
+		metav1.Condition{
+			Type:    tunnelv1alpha1.TunnelConditionCreatedType,
+			Status:  metav1.ConditionTrue,
+			Reason:  tunnelv1alpha1.TunnelConditionCreatedRecreatedReason,
+			Message: "Cloudflare tunnel recreated with ID " + cfTunnel.ID + " after " + oldTunnelID + " was deleted",
+		})
+	if err := r.updateStatus(ctx, t); err != nil {
+		// the next reconciliation recreates the tunnel again and repoints the records from the old tunnel,
+		// the records already repointed to the new one are fixed when creating missing records
+		log.Error(err, "Failed to update Tunnel status")
+		log.Info("deleting cloudflare tunnel " + cfTunnel.ID)
+		_ = api.DeleteArgoTunnel(ctx, cfTunnel.ID)
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Eventf(t, corev1.EventTypeWarning, "TunnelRecreated",
+		"Cloudflare tunnel %s was deleted out-of-band, recreated it as %s and repointed %d DNS records",
+		oldTunnelID, cfTunnel.ID, len(t.Status.IngressHostnames))
 	return ctrl.Result{}, nil
 }
 
+// rotateTunnelSecret replaces the secret of the tunnel of t, writes it in the tunnel secret and rolls the deployment.
+// A failure before the rotation is recorded in the status triggers a new rotation on the next reconciliation.
+func (r *TunnelReconciler) rotateTunnelSecret(ctx context.Context, CF *Cloudflare, t *tunnelv1alpha1.Tunnel, rotation string) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	secretB64, err := newTunnelSecretB64()
+	if err != nil {
+		log.Error(err, "Failed to generate tunnel secret")
+		return ctrl.Result{}, err
+	}
+	log.Info("rotating the secret of cloudflare tunnel " + t.Status.TunnelID)
+	if err := CF.Client().UpdateTunnelSecret(ctx, t.Status.TunnelID, secretB64); err != nil {
+		log.Error(err, "Failed to rotate the cloudflare tunnel secret")
+		return ctrl.Result{}, err
+	}
+	if err := r.writeTunnelSecret(ctx, t, secretB64); err != nil {
+		log.Error(err, "Failed to write tunnel secret")
+		return ctrl.Result{}, err
+	}
+
+	// the rotation is set in the pod template of the deployment, rolling it
+	t.Status.SecretRotation = rotation
+	err = r.Get(ctx, types.NamespacedName{Namespace: t.Namespace, Name: t.Name}, &appsv1.Deployment{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "failed to get Deployment")
+		return ctrl.Result{}, err
+	}
+	if err == nil && t.Spec.Run {
+		dep, err := r.deploymentForTunnelRun(t, tunnelSecretHash(r.newTunnelSecret(t, secretB64)))
+		if err != nil {
+			log.Error(err, "Failed to compute the Deployment")
+			return ctrl.Result{}, err
+		}
+		if err := r.apply(ctx, dep); err != nil {
+			log.Error(err, "failed to roll Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.updateStatus(ctx, t); err != nil {
+		log.Error(err, "Failed to update Tunnel status")
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(t, corev1.EventTypeNormal, "SecretRotated", "Rotated the secret of cloudflare tunnel "+t.Status.TunnelID)
+	return ctrl.Result{}, nil
+}
+
+// recordDNSRecordsDeleted emits an event on t for the deleted CNAME records of hostname, or for the records left in
+// place because they are not owned by t. It returns err unless the records were left in place.
+func (r *TunnelReconciler) recordDNSRecordsDeleted(t *tunnelv1alpha1.Tunnel, hostname string, deleted int, err error) error {
+	if deleted > 0 {
+		r.Recorder.Eventf(t, corev1.EventTypeNormal, "DNSRecordDeleted", "Deleted %d CNAME records of %s", deleted, hostname)
+	}
+	if errors.Is(err, errDNSRecordNotOwned) {
+		r.Recorder.Event(t, corev1.EventTypeWarning, "DNSRecordNotOwned", "Left the CNAME records of "+hostname+" in place: they are not owned by the Tunnel")
+		return nil
+	}
+	return err
+}
+
 func inSlice(str string, slice []string) bool {
 	for _, s := range slice {
 		if s == str {
@@ -325,50 +865,257 @@ func inSlice(str string, slice []string) bool {
 	return false
 }
 
+func removeFromSlice(str string, slice []string) []string {
+	kept := []string{}
+	for _, s := range slice {
+		if s != str {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
 func (r *TunnelReconciler) newTunnelSecret(t *tunnelv1alpha1.Tunnel, secretB64 string) *corev1.Secret {
-	secret := t.BaseTunnelSecret()
-	credentials := map[string]string{
-		"AccountTag":   t.Status.AccountID,
-		"TunnelID":     t.Status.TunnelID,
-		"TunnelName":   t.Spec.Name,
-		"TunnelSecret": secretB64,
+	credentials := tunnelCredentials{
+		AccountTag:   t.Status.AccountID,
+		TunnelID:     t.Status.TunnelID,
+		TunnelName:   t.Spec.Name,
+		TunnelSecret: secretB64,
 	}
 	credentialsJson, _ := json.Marshal(credentials)
-	configYaml, _ := yaml.Marshal(tunnelConfig(t))
-	secret.StringData = map[string]string{
-		"credentials.json": string(credentialsJson),
-		"config.yaml":      string(configYaml),
+	return r.tunnelSecret(t, credentialsJson)
+}
+
+// tunnelTokenContent is the content of a tunnel token, as accepted by cloudflared tunnel run --token
+type tunnelTokenContent struct {
+	AccountTag   string `json:"a"`
+	TunnelID     string `json:"t"`
+	TunnelSecret string `json:"s"`
+}
+
+// tunnelToken returns the token running the tunnel of credentialsJson, empty when the credentials are invalid
+func tunnelToken(credentialsJson []byte) string {
+	credentials := tunnelCredentials{}
+	if err := json.Unmarshal(credentialsJson, &credentials); err != nil || credentials.TunnelID == "" {
+		return ""
+	}
+	token, _ := json.Marshal(tunnelTokenContent{
+		AccountTag:   credentials.AccountTag,
+		TunnelID:     credentials.TunnelID,
+		TunnelSecret: credentials.TunnelSecret,
+	})
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// tunnelSecret returns the tunnel secret of t holding credentialsJson, the token derived from them and the
+// configuration of the tunnel, to be applied. The configuration of a remotely configured tunnel is not in its secret.
+func (r *TunnelReconciler) tunnelSecret(t *tunnelv1alpha1.Tunnel, credentialsJson []byte) *corev1.Secret {
+	secret := t.BaseTunnelSecret()
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	token := tunnelToken(credentialsJson)
+	secret.Data = map[string][]byte{
+		"credentials.json":                  credentialsJson,
+		tunnelv1alpha1.TunnelSecretTokenKey: []byte(token),
+	}
+	if t.Spec.SecretEnvFile {
+		secret.Data[tunnelv1alpha1.TunnelSecretEnvFileKey] = []byte("TUNNEL_TOKEN=" + token + "\n")
+	}
+	if !t.IsRemotelyConfigured() {
+		configYaml, _ := yaml.Marshal(tunnelConfig(t))
+		secret.Data["config.yaml"] = configYaml
 	}
 	ctrl.SetControllerReference(t, secret, r.Scheme)
 	return secret
 }
 
-func (r *TunnelReconciler) updateTunnelSecretConfig(ctx context.Context, t *tunnelv1alpha1.Tunnel) error {
-	secret := t.BaseTunnelSecret()
-	objectKey := client.ObjectKey{Namespace: secret.Namespace, Name: secret.Name}
-	if err := r.Get(ctx, objectKey, secret); err != nil {
-		return errors.New("failed to retrieve secret: " + err.Error())
+// writeTunnelSecret applies the tunnel secret of t with the credentials of its tunnel, taking ownership of an
+// existing secret
+func (r *TunnelReconciler) writeTunnelSecret(ctx context.Context, t *tunnelv1alpha1.Tunnel, secretB64 string) error {
+	s := r.newTunnelSecret(t, secretB64)
+	err := r.Get(ctx, client.ObjectKeyFromObject(s), &corev1.Secret{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if err := r.apply(ctx, s); err != nil {
+		return err
 	}
-	configYaml, _ := yaml.Marshal(tunnelConfig(t))
-	secret.Data["config.yaml"] = configYaml
-	if err := r.Update(ctx, secret); err != nil {
-		return errors.New("failed to update secret: " + err.Error())
+	if !exists {
+		r.Recorder.Event(t, corev1.EventTypeNormal, "SecretCreated", "Created tunnel secret "+s.Name)
+		return nil
 	}
+	r.Recorder.Event(t, corev1.EventTypeNormal, "SecretUpdated", "Wrote new credentials in tunnel secret "+s.Name)
 	return nil
 }
 
-func (r *TunnelReconciler) deploymentForTunnelRun(t *tunnelv1alpha1.Tunnel) *appsv1.Deployment {
-	dep := t.DeploymentForTunnelRun()
+// updateTunnelSecretConfig applies the configuration of the tunnel to its secret, keeping its credentials,
+// and returns the tunnelSecretHash of the applied secret
+func (r *TunnelReconciler) updateTunnelSecretConfig(ctx context.Context, t *tunnelv1alpha1.Tunnel) (string, error) {
+	current := t.BaseTunnelSecret()
+	if err := r.Get(ctx, client.ObjectKeyFromObject(current), current); err != nil {
+		return "", errors.New("failed to retrieve secret: " + err.Error())
+	}
+	secret := r.tunnelSecret(t, current.Data["credentials.json"])
+	if err := r.apply(ctx, secret); err != nil {
+		return "", errors.New("failed to update secret: " + err.Error())
+	}
+	return tunnelSecretHash(secret), nil
+}
+
+// tunnelSecretHash returns the hash of the configuration and credentials held by a tunnel secret. The configuration
+// of a remotely configured tunnel is not in its secret: changing it does not roll the deployment.
+func tunnelSecretHash(secret *corev1.Secret) string {
+	h := sha256.New()
+	for _, key := range []string{"config.yaml", "credentials.json"} {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(secret.Data[key])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fieldOwner is the field manager of the objects written by the operator
+const fieldOwner = client.FieldOwner("tunnel-operator")
+
+// apply creates or updates obj with server-side apply: the fields set in obj are owned by the operator and
+// reverted when changed by others, the fields owned by other managers are preserved
+func (r *TunnelReconciler) apply(ctx context.Context, obj client.Object) error {
+	return r.Patch(ctx, obj, client.Apply, fieldOwner, client.ForceOwnership)
+}
+
+// deploymentForTunnelRun returns the deployment running the tunnel of t to be applied, rolled when configHash changes
+// unless t has a manual rollout
+func (r *TunnelReconciler) deploymentForTunnelRun(t *tunnelv1alpha1.Tunnel, configHash string) (*appsv1.Deployment, error) {
+	dep, err := t.DeploymentForTunnelRun(r.CloudflaredImage)
+	if err != nil {
+		return nil, err
+	}
+	dep.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+	if dep.Spec.Template.Annotations == nil {
+		dep.Spec.Template.Annotations = map[string]string{}
+	}
+	if t.Status.SecretRotation != "" {
+		dep.Spec.Template.Annotations[tunnelv1alpha1.TunnelSecretRotationAnnotation] = t.Status.SecretRotation
+	}
+	if configHash != "" && !t.Spec.ManualRollout {
+		dep.Spec.Template.Annotations[tunnelv1alpha1.TunnelConfigHashAnnotation] = configHash
+	}
 	ctrl.SetControllerReference(t, dep, r.Scheme)
-	return dep
+	return dep, nil
+}
+
+// tunnelsForSecret maps a secret to the Tunnels referencing it as account or adoption secret
+func (r *TunnelReconciler) tunnelsForSecret(secret client.Object) []reconcile.Request {
+	requests := []reconcile.Request{}
+	for _, indexKey := range []string{accountSecretIndexKey, adoptSecretIndexKey} {
+		tunnels := &tunnelv1alpha1.TunnelList{}
+		err := r.List(context.Background(), tunnels,
+			client.InNamespace(secret.GetNamespace()),
+			client.MatchingFields{indexKey: secret.GetName()})
+		if err != nil {
+			return nil
+		}
+		for _, t := range tunnels.Items {
+			request := reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: t.Namespace, Name: t.Name},
+			}
+			if !containsRequest(requests, request) {
+				requests = append(requests, request)
+			}
+		}
+	}
+	return requests
+}
+
+func containsRequest(requests []reconcile.Request, request reconcile.Request) bool {
+	for _, r := range requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+// accountRefIndexValue returns the accountRefIndexKey value of an account
+func accountRefIndexValue(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// tunnelsForAccount maps a CloudflareAccount or ClusterCloudflareAccount to the Tunnels referencing it
+func (r *TunnelReconciler) tunnelsForAccount(account client.Object) []reconcile.Request {
+	kind := tunnelv1alpha1.CloudflareAccountKind
+	if _, ok := account.(*tunnelv1alpha1.ClusterCloudflareAccount); ok {
+		kind = tunnelv1alpha1.ClusterCloudflareAccountKind
+	}
+	tunnels := &tunnelv1alpha1.TunnelList{}
+	err := r.List(context.Background(), tunnels,
+		client.MatchingFields{accountRefIndexKey: accountRefIndexValue(kind, account.GetNamespace(), account.GetName())})
+	if err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, t := range tunnels.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: t.Namespace, Name: t.Name},
+		})
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *TunnelReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &tunnelv1alpha1.Tunnel{}, accountSecretIndexKey,
+		func(o client.Object) []string {
+			t := o.(*tunnelv1alpha1.Tunnel)
+			if t.Spec.AccountSecret == nil {
+				return nil
+			}
+			return []string{t.Spec.AccountSecret.Name}
+		})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &tunnelv1alpha1.Tunnel{}, adoptSecretIndexKey,
+		func(o client.Object) []string {
+			t := o.(*tunnelv1alpha1.Tunnel)
+			if t.Spec.Adopt == nil {
+				return nil
+			}
+			return []string{t.Spec.Adopt.SecretName}
+		})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &tunnelv1alpha1.Tunnel{}, accountRefIndexKey,
+		func(o client.Object) []string {
+			t := o.(*tunnelv1alpha1.Tunnel)
+			ref := t.Spec.AccountRef
+			if ref == nil {
+				return nil
+			}
+			if ref.Kind == tunnelv1alpha1.ClusterCloudflareAccountKind {
+				return []string{accountRefIndexValue(ref.Kind, "", ref.Name)}
+			}
+			namespace := ref.Namespace
+			if namespace == "" {
+				namespace = t.Namespace
+			}
+			return []string{accountRefIndexValue(tunnelv1alpha1.CloudflareAccountKind, namespace, ref.Name)}
+		})
+	if err != nil {
+		return err
+	}
+	if err := metrics.Registry.Register(&tunnelCollector{client: mgr.GetClient()}); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&tunnelv1alpha1.Tunnel{}).
 		Owns(&corev1.Secret{}).
 		Owns(&appsv1.Deployment{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.tunnelsForSecret)).
+		Watches(&source.Kind{Type: &tunnelv1alpha1.CloudflareAccount{}}, handler.EnqueueRequestsFromMapFunc(r.tunnelsForAccount)).
+		Watches(&source.Kind{Type: &tunnelv1alpha1.ClusterCloudflareAccount{}}, handler.EnqueueRequestsFromMapFunc(r.tunnelsForAccount)).
 		// WithOptions(controller.Options{MaxConcurrentReconciles: 2}).
 		Complete(r)
 }
@@ -0,0 +1,1515 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tunnelv1alpha1 "github.com/patjlm/tunnel-operator/api/v1alpha1"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflareapi"
+	"github.com/patjlm/tunnel-operator/controllers/cloudflarefake"
+)
+
+const (
+	timeout  = time.Second * 10
+	interval = time.Millisecond * 250
+)
+
+// newTestTunnel returns a Tunnel in the default namespace routing the given hostnames
+func newTestTunnel(name string, hostnames ...string) *tunnelv1alpha1.Tunnel {
+	ingresses := []tunnelv1alpha1.TunnelIngress{}
+	for _, hostname := range hostnames {
+		service := "http://" + strings.Split(hostname, ".")[0] + ".default.svc"
+		ingresses = append(ingresses, tunnelv1alpha1.TunnelIngress{HostName: hostname, Service: &service})
+	}
+	return &tunnelv1alpha1.Tunnel{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: tunnelv1alpha1.TunnelSpec{
+			Name:    name,
+			Ingress: &ingresses,
+		},
+	}
+}
+
+// getTunnel fetches the current state of a tunnel
+func getTunnel(ctx context.Context, key types.NamespacedName) func() (*tunnelv1alpha1.Tunnel, error) {
+	return func() (*tunnelv1alpha1.Tunnel, error) {
+		tunnel := &tunnelv1alpha1.Tunnel{}
+		err := k8sClient.Get(ctx, key, tunnel)
+		return tunnel, err
+	}
+}
+
+// cnameContents returns the contents of the CNAME records of hostname in the test zone
+func cnameContents(hostname string) []string {
+	return zoneCNAMEContents(testZoneName, hostname)
+}
+
+// zoneCNAMEContents returns the contents of the CNAME records of hostname in the given zone
+func zoneCNAMEContents(zoneName, hostname string) []string {
+	contents := []string{}
+	for _, r := range fakeCloudflare.Records(zoneName) {
+		if r.Type == "CNAME" && r.Name == hostname {
+			contents = append(contents, r.Content)
+		}
+	}
+	return contents
+}
+
+// updateTunnel applies update to the current state of a tunnel, retrying on conflicts with the controller
+func updateTunnel(ctx context.Context, key types.NamespacedName, update func(*tunnelv1alpha1.Tunnel)) {
+	Eventually(func() error {
+		tunnel, err := getTunnel(ctx, key)()
+		if err != nil {
+			return err
+		}
+		update(tunnel)
+		return k8sClient.Update(ctx, tunnel)
+	}, timeout, interval).Should(Succeed())
+}
+
+// tunnelCondition fetches the current condition of a tunnel with the given type
+func tunnelCondition(ctx context.Context, key types.NamespacedName, conditionType string) func() *metav1.Condition {
+	return func() *metav1.Condition {
+		tunnel, err := getTunnel(ctx, key)()
+		if err != nil {
+			return nil
+		}
+		return apimeta.FindStatusCondition(tunnel.Status.Conditions, conditionType)
+	}
+}
+
+// tunnelEvents returns the reason and message of the events emitted on a tunnel
+func tunnelEvents(ctx context.Context, key types.NamespacedName) func() ([]string, error) {
+	return func() ([]string, error) {
+		events := &corev1.EventList{}
+		if err := k8sClient.List(ctx, events, client.InNamespace(key.Namespace)); err != nil {
+			return nil, err
+		}
+		reasons := []string{}
+		for _, e := range events.Items {
+			if e.InvolvedObject.Kind == "Tunnel" && e.InvolvedObject.Name == key.Name {
+				reasons = append(reasons, e.Reason+": "+e.Message)
+			}
+		}
+		return reasons, nil
+	}
+}
+
+// createdTunnel creates a Tunnel and waits for its cloudflare tunnel to be recorded in its status
+func createdTunnel(ctx context.Context, tunnel *tunnelv1alpha1.Tunnel) *tunnelv1alpha1.Tunnel {
+	Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+	key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+	Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", Not(BeEmpty())))
+	created, err := getTunnel(ctx, key)()
+	Expect(err).NotTo(HaveOccurred())
+	return created
+}
+
+var _ = Describe("Tunnel controller", func() {
+	ctx := context.Background()
+
+	It("creates the cloudflare tunnel and its secret", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("create", "create.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		Expect(tunnel.Finalizers).To(ContainElement(tunnelFinalizer))
+		Expect(tunnel.Status.AccountID).To(Equal(testAccountID))
+		Expect(apimeta.IsStatusConditionTrue(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)).To(BeTrue())
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(And(
+			HaveField("ID", tunnel.Status.TunnelID),
+			HaveField("Name", "create"),
+		)))
+
+		secret := &corev1.Secret{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, secret) }, timeout, interval).Should(Succeed())
+		Expect(metav1.IsControlledBy(secret, tunnel)).To(BeTrue())
+		credentials := map[string]string{}
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &credentials)).To(Succeed())
+		Expect(credentials).To(HaveKeyWithValue("AccountTag", testAccountID))
+		Expect(credentials).To(HaveKeyWithValue("TunnelID", tunnel.Status.TunnelID))
+		Expect(credentials).To(HaveKeyWithValue("TunnelName", "create"))
+		Expect(credentials["TunnelSecret"]).NotTo(BeEmpty())
+		Expect(string(secret.Data["config.yaml"])).To(ContainSubstring("tunnel: " + tunnel.Status.TunnelID))
+
+		Eventually(func() []string { return cnameContents("create.example.com") }, timeout, interval).
+			Should(ConsistOf(tunnel.Status.TunnelID + ".cfargotunnel.com"))
+	})
+
+	It("writes the tunnel token and its environment file in the tunnel secret", func() {
+		tunnel := newTestTunnel("token", "token.example.com")
+		tunnel.Spec.Run = true
+		tunnel.Spec.SecretEnvFile = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		secret := &corev1.Secret{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, secret) }, timeout, interval).Should(Succeed())
+		credentials := map[string]string{}
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &credentials)).To(Succeed())
+		token := string(secret.Data[tunnelv1alpha1.TunnelSecretTokenKey])
+		decoded, err := b64.StdEncoding.DecodeString(token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(MatchJSON(`{"a":"` + testAccountID + `","t":"` + tunnel.Status.TunnelID + `","s":"` + credentials["TunnelSecret"] + `"}`))
+		Expect(string(secret.Data[tunnelv1alpha1.TunnelSecretEnvFileKey])).To(Equal("TUNNEL_TOKEN=" + token + "\n"))
+		Expect(secret.Data).To(HaveKey("config.yaml"))
+
+		By("running cloudflared with the token and the local configuration")
+		deployment := &appsv1.Deployment{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, deployment) }, timeout, interval).Should(Succeed())
+		Expect(deployment.Spec.Template.Spec.Containers).To(ConsistOf(And(
+			HaveField("Args", And(ContainElements("--config", "/config/config.yaml"), Not(ContainElement("--credentials-file")))),
+			HaveField("Env", ConsistOf(HaveField("ValueFrom.SecretKeyRef", PointTo(And(
+				HaveField("Name", secret.Name),
+				HaveField("Key", tunnelv1alpha1.TunnelSecretTokenKey),
+			))))),
+		)))
+
+		By("removing the environment file when it is no longer requested")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.SecretEnvFile = false })
+		Eventually(func() (map[string][]byte, error) {
+			err := k8sClient.Get(ctx, key, secret)
+			return secret.Data, err
+		}, timeout, interval).ShouldNot(HaveKey(tunnelv1alpha1.TunnelSecretEnvFileKey))
+	})
+
+	It("resolves the cloudflare credentials from its account secret", func() {
+		tunnel := newTestTunnel("account-secret")
+		tunnel.Spec.AccountSecret = &corev1.SecretReference{Name: "account-secret-creds"}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		By("reporting a missing secret")
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsNotFoundReason),
+			)))
+
+		By("reporting a secret missing a key")
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "account-secret-creds", Namespace: "default"},
+			StringData: map[string]string{accountSecretAPITokenKey: "secret-token"},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsInvalidReason),
+				HaveField("Message", ContainSubstring(accountSecretAccountIDKey)),
+			)))
+
+		By("creating the tunnel once the secret is complete")
+		secret.StringData = map[string]string{accountSecretAccountIDKey: testAccountID}
+		Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", Not(BeEmpty())))
+		Expect(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType)()).To(PointTo(And(
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsSuccessReason),
+		)))
+	})
+
+	It("only reads account secrets from its own namespace", func() {
+		tunnel := newTestTunnel("account-secret-namespace")
+		tunnel.Spec.AccountSecret = &corev1.SecretReference{Name: "account-secret-creds", Namespace: "kube-system"}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCredentialsType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCredentialsInvalidReason),
+				HaveField("Message", ContainSubstring("must be in the Tunnel namespace default")),
+			)))
+		Consistently(getTunnel(ctx, key), time.Second, interval).Should(HaveField("Status.TunnelID", BeEmpty()))
+	})
+
+	It("keys the cloudflare clients by credentials without holding their API token", func() {
+		clients := &cloudflareClients{}
+		creds := cloudflareCredentials{APIToken: "first-token", AccountID: "keyed-account", Source: "secret default/first"}
+		first, err := clients.Get(ctx, creds, newFakeCloudflareClient, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clients.Get(ctx, creds, newFakeCloudflareClient, 0)).To(BeIdenticalTo(first))
+		Expect(clients.clients).To(HaveLen(1))
+		for key := range clients.clients {
+			Expect(key.AccountID).To(Equal("keyed-account"))
+			Expect(key.TokenHash).NotTo(ContainSubstring("first-token"))
+		}
+
+		By("keeping the clients of other credentials of the same account")
+		other := cloudflareCredentials{APIToken: "other-token", AccountID: "keyed-account", ZoneName: testZoneName, Source: "environment"}
+		otherClient, err := clients.Get(ctx, other, newFakeCloudflareClient, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clients.Get(ctx, creds, newFakeCloudflareClient, 0)).To(BeIdenticalTo(first))
+		Expect(clients.Get(ctx, other, newFakeCloudflareClient, 0)).To(BeIdenticalTo(otherClient))
+		Expect(clients.clients).To(HaveLen(2))
+
+		By("dropping the client of the previous token of the same source")
+		creds.APIToken = "second-token"
+		second, err := clients.Get(ctx, creds, newFakeCloudflareClient, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).NotTo(BeIdenticalTo(first))
+		Expect(clients.clients).To(HaveLen(2))
+		Expect(clients.clients).To(HaveKey(clientKey(other)))
+
+		By("dropping the clients which are no longer used")
+		clients.clients[clientKey(other)].lastUsed = time.Now().Add(-2 * cloudflareClientIdleTimeout)
+		Expect(clients.Get(ctx, creds, newFakeCloudflareClient, 0)).To(BeIdenticalTo(second))
+		Expect(clients.clients).To(HaveLen(1))
+		Expect(clients.clients).To(HaveKey(clientKey(creds)))
+	})
+
+	It("adds and removes DNS records following the ingress rules", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("dns", "dns-a.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("dns-a.example.com")))
+
+		By("adding an ingress rule")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("dns", "dns-a.example.com", "dns-b.example.com").Spec.Ingress
+		})
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("dns-a.example.com", "dns-b.example.com")))
+		Eventually(func() []string { return cnameContents("dns-b.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+
+		By("removing an ingress rule")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("dns", "dns-b.example.com").Spec.Ingress
+		})
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("dns-b.example.com")))
+		Eventually(func() []string { return cnameContents("dns-a.example.com") }, timeout, interval).Should(BeEmpty())
+		Expect(cnameContents("dns-b.example.com")).To(ConsistOf(content))
+
+		secret := &corev1.Secret{}
+		Eventually(func() (string, error) {
+			err := k8sClient.Get(ctx, key, secret)
+			return string(secret.Data["config.yaml"]), err
+		}, timeout, interval).Should(And(
+			ContainSubstring("dns-b.example.com"),
+			Not(ContainSubstring("dns-a.example.com")),
+		))
+	})
+
+	It("creates and deletes the Deployment when run is toggled", func() {
+		tunnel := newTestTunnel("run", "run.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		deployment := &appsv1.Deployment{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, deployment) }, timeout, interval).Should(Succeed())
+		Expect(metav1.IsControlledBy(deployment, tunnel)).To(BeTrue())
+		Expect(deployment.Labels).To(HaveKeyWithValue("tunnel-id", tunnel.Status.TunnelID))
+		Expect(deployment.Spec.Template.Spec.Volumes).To(ContainElement(
+			HaveField("VolumeSource.Secret.SecretName", tunnel.Name)))
+
+		By("disabling run")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.Run = false })
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &appsv1.Deployment{}))
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("runs cloudflared with the replicas and pod template of the Tunnel merged into the defaults", func() {
+		var replicas int32 = 2
+		tunnel := newTestTunnel("overlay", "overlay.example.com")
+		tunnel.Spec.Run = true
+		tunnel.Spec.Replicas = &replicas
+		tunnel.Spec.PodTemplate = &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "web"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name: "cloudflared",
+					Env:  []corev1.EnvVar{{Name: "TUNNEL_LOGLEVEL", Value: "debug"}},
+				}},
+			},
+		}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		deployment := &appsv1.Deployment{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, deployment) }, timeout, interval).Should(Succeed())
+		Expect(deployment.Spec.Replicas).To(PointTo(BeEquivalentTo(2)))
+		Expect(deployment.Spec.Template.Labels).To(And(
+			HaveKeyWithValue("team", "web"),
+			HaveKeyWithValue("tunnel-id", tunnel.Status.TunnelID),
+		))
+		Expect(deployment.Spec.Template.Spec.Containers).To(ConsistOf(And(
+			HaveField("Name", "cloudflared"),
+			HaveField("Image", tunnelv1alpha1.DefaultCloudflaredImage),
+			HaveField("Env", ConsistOf(
+				HaveField("Name", "TUNNEL_TOKEN"),
+				corev1.EnvVar{Name: "TUNNEL_LOGLEVEL", Value: "debug"},
+			)),
+			HaveField("VolumeMounts", ContainElement(HaveField("MountPath", "/config"))),
+		)))
+
+		By("leaving the spec of the Tunnel untouched")
+		tunnel, err := getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Spec.DeploymentSpec).To(BeNil())
+		Expect(tunnel.Generation).To(BeEquivalentTo(1))
+	})
+
+	It("keeps the default containers when the pod template of the Tunnel only sets metadata", func() {
+		tunnel := newTestTunnel("overlay-metadata", "overlay-metadata.example.com")
+		tunnel.Spec.Run = true
+		tunnel.Spec.PodTemplate = &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"example.com/team": "web"}},
+		}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		deployment := &appsv1.Deployment{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, deployment) }, timeout, interval).Should(Succeed())
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue("example.com/team", "web"))
+		Expect(deployment.Spec.Template.Spec.Containers).To(ConsistOf(And(
+			HaveField("Name", "cloudflared"),
+			HaveField("Image", tunnelv1alpha1.DefaultCloudflaredImage),
+		)))
+		Expect(deployment.Spec.Template.Spec.Volumes).NotTo(BeEmpty())
+	})
+
+	It("ignores the deployment spec written back by older versions but keeps a customized one", func() {
+		// legacyDeploymentSpec is the default deployment spec older versions wrote into the Tunnels
+		legacyDeploymentSpec := func(secretName string) *appsv1.DeploymentSpec {
+			var replicas int32 = 1
+			optional := true
+			labels := map[string]string{"app": "cloudflared-run", "tunnel-id": "4a0ac5a6-7e8f-4b8b-9c3c-53e7b5d0a2f1"}
+			return &appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{
+							Image: "cloudflare/cloudflared:2022.3.0",
+							Name:  "cloudflared",
+							Args: []string{
+								"tunnel",
+								"--config", "/config/config.yaml",
+								"--metrics", "0.0.0.0:10000",
+								"run",
+								"--credentials-file", "/config/credentials.json",
+							},
+							Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 10000}},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "cloudflared-config", MountPath: "/config", ReadOnly: true},
+								{Name: "openshift-ca", MountPath: "/openshift-ca", ReadOnly: true},
+							},
+						}},
+						Volumes: []corev1.Volume{
+							{
+								Name: "cloudflared-config",
+								VolumeSource: corev1.VolumeSource{
+									Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+								},
+							},
+							{
+								Name: "openshift-ca",
+								VolumeSource: corev1.VolumeSource{
+									ConfigMap: &corev1.ConfigMapVolumeSource{
+										LocalObjectReference: corev1.LocalObjectReference{Name: "openshift-ca"},
+										Optional:             &optional,
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+		}
+		cloudflaredContainer := func(key types.NamespacedName) func() ([]corev1.Container, error) {
+			return func() ([]corev1.Container, error) {
+				deployment := &appsv1.Deployment{}
+				err := k8sClient.Get(ctx, key, deployment)
+				return deployment.Spec.Template.Spec.Containers, err
+			}
+		}
+
+		tunnel := newTestTunnel("legacy", "legacy.example.com")
+		tunnel.Spec.Run = true
+		tunnel.Spec.DeploymentSpec = legacyDeploymentSpec(tunnel.Name)
+		tunnel = createdTunnel(ctx, tunnel)
+		Eventually(cloudflaredContainer(types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}), timeout, interval).
+			Should(ConsistOf(And(
+				HaveField("Image", tunnelv1alpha1.DefaultCloudflaredImage),
+				HaveField("Args", Not(ContainElement("--credentials-file"))),
+				HaveField("Env", ContainElement(HaveField("Name", "TUNNEL_TOKEN"))),
+			)))
+
+		By("keeping a customized deployment spec")
+		customized := newTestTunnel("legacy-customized", "legacy-customized.example.com")
+		customized.Spec.Run = true
+		customized.Spec.DeploymentSpec = legacyDeploymentSpec(customized.Name)
+		customized.Spec.DeploymentSpec.Template.Spec.NodeSelector = map[string]string{"role": "edge"}
+		customized = createdTunnel(ctx, customized)
+		Eventually(cloudflaredContainer(types.NamespacedName{Namespace: customized.Namespace, Name: customized.Name}), timeout, interval).
+			Should(ConsistOf(HaveField("Image", "cloudflare/cloudflared:2022.3.0")))
+	})
+
+	It("applies the changes of the Tunnel to its Deployment and reverts the changes made to the fields it owns", func() {
+		tunnel := newTestTunnel("apply", "apply.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		deployment := func() (*appsv1.Deployment, error) {
+			deployment := &appsv1.Deployment{}
+			err := k8sClient.Get(ctx, key, deployment)
+			return deployment, err
+		}
+		Eventually(deployment, timeout, interval).Should(HaveField("ManagedFields",
+			ContainElement(HaveField("Manager", "tunnel-operator"))))
+
+		By("rolling out the changes of the Tunnel")
+		var replicas int32 = 3
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.Replicas = &replicas })
+		Eventually(deployment, timeout, interval).Should(HaveField("Spec.Replicas", PointTo(BeEquivalentTo(3))))
+
+		By("reverting the changes made to its fields and preserving the others")
+		Eventually(func() error {
+			current, err := deployment()
+			if err != nil {
+				return err
+			}
+			current.Spec.Template.Spec.Containers[0].Image = "cloudflare/cloudflared:edited"
+			current.Spec.Template.Annotations = map[string]string{"example.com/restartedAt": "now"}
+			return k8sClient.Update(ctx, current)
+		}, timeout, interval).Should(Succeed())
+		Eventually(deployment, timeout, interval).Should(And(
+			HaveField("Spec.Template.Spec.Containers", ConsistOf(HaveField("Image", tunnelv1alpha1.DefaultCloudflaredImage))),
+			HaveField("Spec.Template.Annotations", HaveKeyWithValue("example.com/restartedAt", "now")),
+		))
+	})
+
+	It("rolls the Deployment when the configuration of the tunnel changes", func() {
+		tunnel := newTestTunnel("rollout", "rollout-a.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		configHash := func() (string, error) {
+			deployment := &appsv1.Deployment{}
+			err := k8sClient.Get(ctx, key, deployment)
+			return deployment.Spec.Template.Annotations[tunnelv1alpha1.TunnelConfigHashAnnotation], err
+		}
+		Eventually(configHash, timeout, interval).ShouldNot(BeEmpty())
+		initialHash, err := configHash()
+		Expect(err).NotTo(HaveOccurred())
+
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("rollout", "rollout-a.example.com", "rollout-b.example.com").Spec.Ingress
+		})
+		Eventually(configHash, timeout, interval).ShouldNot(Or(BeEmpty(), Equal(initialHash)))
+
+		By("leaving the rollout to the user with manualRollout")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.ManualRollout = true })
+		Eventually(configHash, timeout, interval).Should(BeEmpty())
+	})
+
+	It("pushes the configuration of a tunnel configured from cloudflare and runs it with its token", func() {
+		tunnel := newTestTunnel("remote", "remote-a.example.com")
+		tunnel.Spec.ConfigSource = tunnelv1alpha1.TunnelConfigSourceCloudflare
+		tunnel.Spec.Run = true
+		connectTimeout := 30 * time.Second
+		(*tunnel.Spec.Ingress)[0].OriginRequest = &tunnelv1alpha1.OriginRequestConfig{ConnectTimeout: &connectTimeout}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		remoteConfig := func() []cloudflareapi.TunnelIngressRule {
+			config, _ := fakeCloudflare.Configuration(tunnel.Status.TunnelID)
+			return config.Ingress
+		}
+		Eventually(remoteConfig, timeout, interval).Should(Equal([]cloudflareapi.TunnelIngressRule{
+			{
+				Hostname:      "remote-a.example.com",
+				Service:       "http://remote-a.default.svc",
+				OriginRequest: map[string]interface{}{"connectTimeout": float64(30)},
+			},
+			{Service: "http_status:404"},
+		}))
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionConfigSyncedType), timeout, interval).
+			Should(HaveField("Reason", tunnelv1alpha1.TunnelConditionConfigSyncedRemoteSuccessReason))
+
+		By("running cloudflared with the token of the tunnel")
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, key, secret)).To(Succeed())
+		Expect(secret.Data).NotTo(HaveKey("config.yaml"))
+		token := map[string]string{}
+		decoded, err := b64.StdEncoding.DecodeString(string(secret.Data[tunnelv1alpha1.TunnelSecretTokenKey]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(json.Unmarshal(decoded, &token)).To(Succeed())
+		Expect(token).To(And(
+			HaveKeyWithValue("a", testAccountID),
+			HaveKeyWithValue("t", tunnel.Status.TunnelID),
+			HaveKeyWithValue("s", Not(BeEmpty())),
+		))
+		deployment := &appsv1.Deployment{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, deployment) }, timeout, interval).Should(Succeed())
+		Expect(deployment.Spec.Template.Spec.Containers).To(ConsistOf(And(
+			HaveField("Args", Not(ContainElement("--config"))),
+			HaveField("Env", ContainElement(HaveField("ValueFrom.SecretKeyRef.Key", tunnelv1alpha1.TunnelSecretTokenKey))),
+		)))
+		configHash := deployment.Spec.Template.Annotations[tunnelv1alpha1.TunnelConfigHashAnnotation]
+
+		By("applying the ingress changes without rolling the Deployment")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("remote", "remote-a.example.com", "remote-b.example.com").Spec.Ingress
+		})
+		Eventually(remoteConfig, timeout, interval).Should(ContainElement(HaveField("Hostname", "remote-b.example.com")))
+		Consistently(func() (string, error) {
+			err := k8sClient.Get(ctx, key, deployment)
+			return deployment.Spec.Template.Annotations[tunnelv1alpha1.TunnelConfigHashAnnotation], err
+		}, time.Second, interval).Should(Equal(configHash))
+	})
+
+	It("reverts the out-of-band changes to its remote configuration and reports switching back to local", func() {
+		tunnel := newTestTunnel("remote-revert", "remote-revert.example.com")
+		tunnel.Spec.ConfigSource = tunnelv1alpha1.TunnelConfigSourceCloudflare
+		tunnel.Spec.ResyncPeriod = &metav1.Duration{Duration: time.Second}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		remoteHostnames := func() []string {
+			config, _ := fakeCloudflare.Configuration(tunnel.Status.TunnelID)
+			hostnames := []string{}
+			for _, rule := range config.Ingress {
+				hostnames = append(hostnames, rule.Hostname)
+			}
+			return hostnames
+		}
+		Eventually(remoteHostnames, timeout, interval).Should(ContainElement("remote-revert.example.com"))
+
+		By("editing the configuration in cloudflare")
+		Expect(fakeCloudflare.UpdateTunnelConfiguration(ctx, tunnel.Status.TunnelID, cloudflareapi.TunnelConfiguration{
+			Ingress: []cloudflareapi.TunnelIngressRule{{Service: "http_status:503"}},
+		})).To(Succeed())
+		Eventually(remoteHostnames, timeout, interval).Should(ContainElement("remote-revert.example.com"))
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElement(
+			"RemoteConfigReverted: Reverted the configuration of cloudflare tunnel " + tunnel.Status.TunnelID +
+				" changed out-of-band"))
+
+		By("switching the tunnel back to a local configuration")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.ConfigSource = tunnelv1alpha1.TunnelConfigSourceLocal })
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionConfigSyncedType), timeout, interval).
+			Should(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionConfigSyncedRemoteActiveReason),
+			))
+		Expect(getTunnel(ctx, key)()).To(HaveField("Status.RemoteConfigHash", Not(BeEmpty())))
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElement(HavePrefix("RemoteConfigActive: ")))
+	})
+
+	It("cleans up cloudflare before removing the finalizer", func() {
+		tunnel := newTestTunnel("delete", "delete.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("delete.example.com")))
+		Expect(cnameContents("delete.example.com")).NotTo(BeEmpty())
+		Eventually(func() error { return k8sClient.Get(ctx, key, &appsv1.Deployment{}) }, timeout, interval).Should(Succeed())
+
+		By("failing the first cloudflare deletion")
+		fakeCloudflare.FailNext(cloudflarefake.MethodDeleteArgoTunnel, &cloudflare.APIRequestError{
+			StatusCode: http.StatusInternalServerError,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1001, Message: "internal error"}},
+		})
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &tunnelv1alpha1.Tunnel{}))
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeCloudflare.Tunnels()).NotTo(ContainElement(HaveField("ID", tunnel.Status.TunnelID)))
+		Expect(cnameContents("delete.example.com")).To(BeEmpty())
+
+		// there is no garbage collection in envtest, the deployment is only scaled down
+		deployment := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, key, deployment)).To(Succeed())
+		Expect(deployment.Spec.Replicas).NotTo(BeNil())
+		Expect(*deployment.Spec.Replicas).To(BeEquivalentTo(0))
+		Expect(deployment.ManagedFields).To(And(
+			ContainElement(And(HaveField("Manager", "tunnel-operator"), HaveField("Operation", metav1.ManagedFieldsOperationApply))),
+			Not(ContainElement(HaveField("Operation", metav1.ManagedFieldsOperationUpdate))),
+		))
+	})
+
+	It("does not take over a tunnel which already exists", func() {
+		existing := fakeCloudflare.AddTunnel("exists", "c2VjcmV0")
+		fakeCloudflare.ResetCalls()
+		tunnel := newTestTunnel("exists", "exists.example.com")
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+
+		Eventually(func() *metav1.Condition {
+			tunnel, err := getTunnel(ctx, key)()
+			if err != nil {
+				return nil
+			}
+			return apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)
+		}, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionCreatedExistsReason),
+		))
+		Consistently(getTunnel(ctx, key), time.Second, interval).Should(HaveField("Status.TunnelID", BeEmpty()))
+		Expect(fakeCloudflare.CallCount(cloudflarefake.MethodCreateArgoTunnel)).To(BeZero())
+		Expect(cnameContents("exists.example.com")).To(BeEmpty())
+
+		By("deleting the Tunnel without touching the existing tunnel")
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &tunnelv1alpha1.Tunnel{}))
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", existing.ID)))
+	})
+
+	It("adopts an existing tunnel from its credentials.json", func() {
+		existing := fakeCloudflare.AddTunnel("adopt", "YWRvcHRlZC1zZWNyZXQ=")
+		_, err := fakeCloudflare.AddRecord(testZoneName, cloudflareapi.DNSRecord{DNSRecord: cloudflare.DNSRecord{
+			Type: "CNAME", Name: "adopt.example.com", Content: existing.ID + ".cfargotunnel.com",
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		credentials, err := json.Marshal(tunnelCredentials{
+			AccountTag:   testAccountID,
+			TunnelID:     "00000000-0000-4000-8000-999999999999",
+			TunnelSecret: "YWRvcHRlZC1zZWNyZXQ=",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		adoptSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "adopt-credentials", Namespace: "default"},
+			Data:       map[string][]byte{adoptSecretCredentialsKey: credentials},
+		}
+		Expect(k8sClient.Create(ctx, adoptSecret)).To(Succeed())
+
+		tunnel := newTestTunnel("adopt", "adopt.example.com")
+		tunnel.Spec.Adopt = &tunnelv1alpha1.TunnelAdoption{SecretName: adoptSecret.Name}
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+
+		By("refusing credentials of another tunnel")
+		Eventually(func() *metav1.Condition {
+			tunnel, err := getTunnel(ctx, key)()
+			if err != nil {
+				return nil
+			}
+			return apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)
+		}, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionCreatedAdoptionFailedReason),
+		))
+
+		By("adopting once the credentials are fixed")
+		credentials, err = json.Marshal(tunnelCredentials{
+			AccountTag:   testAccountID,
+			TunnelID:     existing.ID,
+			TunnelSecret: "YWRvcHRlZC1zZWNyZXQ=",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		adoptSecret.Data[adoptSecretCredentialsKey] = credentials
+		Expect(k8sClient.Update(ctx, adoptSecret)).To(Succeed())
+
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", existing.ID))
+		tunnel, err = getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)).
+			To(HaveField("Reason", tunnelv1alpha1.TunnelConditionCreatedAdoptedReason))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", existing.ID)))
+		Expect(fakeCloudflare.Calls(cloudflarefake.MethodCreateArgoTunnel)).NotTo(ContainElement(
+			HaveField("Args", ContainElement("adopt"))))
+		Expect(cnameContents("adopt.example.com")).To(ConsistOf(existing.ID + ".cfargotunnel.com"))
+
+		secret := &corev1.Secret{}
+		Eventually(func() error { return k8sClient.Get(ctx, key, secret) }, timeout, interval).Should(Succeed())
+		written := tunnelCredentials{}
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &written)).To(Succeed())
+		Expect(written.TunnelID).To(Equal(existing.ID))
+		Expect(written.TunnelSecret).To(Equal("YWRvcHRlZC1zZWNyZXQ="))
+		Expect(tunnel.Status.Adopted).To(BeTrue())
+
+		By("retaining the adopted tunnel when the Tunnel is deleted")
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			_, err := getTunnel(ctx, key)()
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", existing.ID)))
+		Expect(fakeCloudflare.Calls(cloudflarefake.MethodDeleteArgoTunnel)).NotTo(ContainElement(
+			HaveField("Args", ContainElement(existing.ID))))
+		Expect(tunnelEvents(ctx, key)()).To(ContainElement(HavePrefix("TunnelRetained: ")))
+	})
+
+	It("deletes an adopted tunnel along with the Tunnel with the Delete deletion policy", func() {
+		existing := fakeCloudflare.AddTunnel("adopt-delete", "YWRvcHRlZC1zZWNyZXQ=")
+		adoptSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "adopt-delete-credentials", Namespace: "default"},
+			StringData: map[string]string{adoptSecretTunnelSecretKey: "YWRvcHRlZC1zZWNyZXQ="},
+		}
+		Expect(k8sClient.Create(ctx, adoptSecret)).To(Succeed())
+		tunnel := newTestTunnel("adopt-delete")
+		tunnel.Spec.Adopt = &tunnelv1alpha1.TunnelAdoption{
+			SecretName:     adoptSecret.Name,
+			DeletionPolicy: tunnelv1alpha1.TunnelDeletionPolicyDelete,
+		}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Expect(tunnel.Status.TunnelID).To(Equal(existing.ID))
+		Expect(tunnel.Status.Adopted).To(BeTrue())
+
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			_, err := getTunnel(ctx, key)()
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeCloudflare.Tunnels()).NotTo(ContainElement(HaveField("ID", existing.ID)))
+	})
+
+	It("binds to a tunnel by ID and reports its out-of-band deletion", func() {
+		existing := fakeCloudflare.AddTunnel("bound", "Ym91bmQtc2VjcmV0")
+		adoptSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "bound-credentials", Namespace: "default"},
+			StringData: map[string]string{adoptSecretTunnelSecretKey: "Ym91bmQtc2VjcmV0"},
+		}
+		Expect(k8sClient.Create(ctx, adoptSecret)).To(Succeed())
+
+		tunnel := newTestTunnel("bound", "bound.example.com")
+		tunnel.Spec.TunnelID = existing.ID
+		tunnel.Spec.Adopt = &tunnelv1alpha1.TunnelAdoption{SecretName: adoptSecret.Name}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Expect(tunnel.Status.TunnelID).To(Equal(existing.ID))
+		Expect(apimeta.IsStatusConditionTrue(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionBoundType)).To(BeTrue())
+
+		By("deleting the cloudflare tunnel out-of-band")
+		fakeCloudflare.RemoveTunnel(existing.ID)
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{"test/trigger": "drift"}
+		})
+		Eventually(func() *metav1.Condition {
+			tunnel, err := getTunnel(ctx, key)()
+			if err != nil {
+				return nil
+			}
+			return apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionBoundType)
+		}, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionBoundDeletedReason),
+		))
+		Consistently(func() []cloudflare.ArgoTunnel { return fakeCloudflare.Tunnels() }, time.Second, interval).
+			ShouldNot(ContainElement(HaveField("Name", "bound")))
+
+		By("deleting the Tunnel although its cloudflare tunnel is gone")
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &tunnelv1alpha1.Tunnel{}))
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("recreates a tunnel deleted out-of-band", func() {
+		tunnel := newTestTunnel("recreate", "recreate.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		oldTunnelID := tunnel.Status.TunnelID
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("recreate.example.com")))
+		Eventually(func() error { return k8sClient.Get(ctx, key, &appsv1.Deployment{}) }, timeout, interval).Should(Succeed())
+
+		fakeCloudflare.RemoveTunnel(oldTunnelID)
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{"test/trigger": "recreate"}
+		})
+
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.TunnelID", And(Not(BeEmpty()), Not(Equal(oldTunnelID)))))
+		tunnel, err := getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		newTunnelID := tunnel.Status.TunnelID
+		Expect(apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)).
+			To(HaveField("Reason", tunnelv1alpha1.TunnelConditionCreatedRecreatedReason))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", newTunnelID)))
+		Expect(cnameContents("recreate.example.com")).To(ConsistOf(newTunnelID + ".cfargotunnel.com"))
+
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, key, secret)).To(Succeed())
+		credentials := tunnelCredentials{}
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &credentials)).To(Succeed())
+		Expect(credentials.TunnelID).To(Equal(newTunnelID))
+
+		Eventually(func() (map[string]string, error) {
+			deployment := &appsv1.Deployment{}
+			err := k8sClient.Get(ctx, key, deployment)
+			return deployment.Labels, err
+		}, timeout, interval).Should(HaveKeyWithValue("tunnel-id", newTunnelID))
+
+		Eventually(func() ([]corev1.Event, error) {
+			events := &corev1.EventList{}
+			err := k8sClient.List(ctx, events, client.InNamespace(key.Namespace))
+			return events.Items, err
+		}, timeout, interval).Should(ContainElement(And(
+			HaveField("InvolvedObject.Name", "recreate"),
+			HaveField("Reason", "TunnelRecreated"),
+			HaveField("Type", corev1.EventTypeWarning),
+		)))
+	})
+
+	It("does not recreate a tunnel missing from the tunnel listing until its deletion is confirmed", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("unlisted", "unlisted.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		tunnelID := tunnel.Status.TunnelID
+
+		fakeCloudflare.SetListed(tunnelID, false)
+		defer fakeCloudflare.SetListed(tunnelID, true)
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{"test/trigger": "unlisted"}
+		})
+
+		Eventually(func() []cloudflarefake.Call { return fakeCloudflare.Calls(cloudflarefake.MethodArgoTunnel) }, timeout, interval).
+			Should(ContainElement(HaveField("Args", ContainElement(tunnelID))))
+		Consistently(getTunnel(ctx, key), 2*time.Second, interval).Should(HaveField("Status.TunnelID", tunnelID))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", tunnelID)))
+		Expect(cnameContents("unlisted.example.com")).To(ConsistOf(tunnelID + ".cfargotunnel.com"))
+	})
+
+	It("refuses to replace its tunnel when its credentials switch to another account", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("switched", "switched.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		tunnelID := tunnel.Status.TunnelID
+
+		createTokenSecret(ctx, "switched-token", accountSecretAPITokenKey)
+		account := newTestAccount("switched", "switched-token")
+		account.Spec.AccountID = rateLimitedAccountID
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		Eventually(accountReadyCondition(ctx, types.NamespacedName{Namespace: account.Namespace, Name: account.Name}, &tunnelv1alpha1.CloudflareAccount{}), timeout, interval).
+			Should(PointTo(HaveField("Status", metav1.ConditionTrue)))
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Name: account.Name}
+		})
+
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionCreatedType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionCreatedAccountChangedReason),
+			)))
+		Expect(getTunnel(ctx, key)()).To(HaveField("Status", And(
+			HaveField("TunnelID", tunnelID),
+			HaveField("AccountID", testAccountID),
+		)))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("ID", tunnelID)))
+	})
+
+	It("rotates the tunnel secret on demand", func() {
+		tunnel := newTestTunnel("rotate", "rotate.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Eventually(func() error { return k8sClient.Get(ctx, key, &appsv1.Deployment{}) }, timeout, interval).Should(Succeed())
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, key, secret)).To(Succeed())
+		credentials := tunnelCredentials{}
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &credentials)).To(Succeed())
+		oldSecret := credentials.TunnelSecret
+		decoded, err := b64.StdEncoding.DecodeString(oldSecret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(HaveLen(tunnelSecretLength))
+
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{tunnelv1alpha1.TunnelRotateSecretAnnotation: "1"}
+		})
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.SecretRotation", "1"))
+
+		Expect(k8sClient.Get(ctx, key, secret)).To(Succeed())
+		Expect(json.Unmarshal(secret.Data["credentials.json"], &credentials)).To(Succeed())
+		Expect(credentials.TunnelSecret).NotTo(Equal(oldSecret))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(And(
+			HaveField("ID", tunnel.Status.TunnelID),
+			HaveField("Secret", credentials.TunnelSecret),
+		)))
+		deployment := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, key, deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue(tunnelv1alpha1.TunnelSecretRotationAnnotation, "1"))
+
+		By("not rotating again for the same annotation value")
+		Consistently(func() []cloudflarefake.Call {
+			return fakeCloudflare.Calls(cloudflarefake.MethodUpdateTunnelSecret)
+		}, time.Second, interval).Should(ConsistOf(HaveField("Args", ContainElement(tunnel.Status.TunnelID))))
+	})
+
+	It("detects and corrects DNS records changed out-of-band", func() {
+		tunnel := newTestTunnel("drift", "drift.example.com")
+		tunnel.Spec.ResyncPeriod = &metav1.Duration{Duration: time.Second}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+		Eventually(func() []string { return cnameContents("drift.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		driftedCondition := func() *metav1.Condition {
+			tunnel, err := getTunnel(ctx, key)()
+			if err != nil {
+				return nil
+			}
+			return apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionDriftedType)
+		}
+		Eventually(driftedCondition, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionDriftedInSyncReason),
+		))
+
+		By("pointing the record elsewhere")
+		for _, r := range fakeCloudflare.Records(testZoneName) {
+			if r.Name == "drift.example.com" {
+				Expect(fakeCloudflare.UpdateDNSRecord(ctx, testZoneID, r.ID, cloudflareapi.DNSRecord{
+					DNSRecord: cloudflare.DNSRecord{Content: "elsewhere.example.net"}})).To(Succeed())
+			}
+		}
+		Eventually(driftedCondition, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Message", ContainSubstring("targets elsewhere.example.net")),
+		))
+		Expect(cnameContents("drift.example.com")).To(ConsistOf("elsewhere.example.net"))
+
+		By("enabling the drift correction")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) { t.Spec.CorrectDrift = true })
+		Eventually(func() []string { return cnameContents("drift.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(driftedCondition, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionFalse),
+		))
+	})
+
+	It("reports tunnel creation failures", func() {
+		fakeCloudflare.FailNext(cloudflarefake.MethodCreateArgoTunnel, &cloudflare.APIRequestError{
+			StatusCode: http.StatusBadRequest,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1000, Message: "bad request"}},
+		})
+		tunnel := createdTunnel(ctx, newTestTunnel("failure", "failure.example.com"))
+
+		// the creation is retried once the failure is reported
+		condition := apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionCreatedType)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(fakeCloudflare.Tunnels()).To(ContainElement(HaveField("Name", "failure")))
+		attempts := 0
+		for _, call := range fakeCloudflare.Calls(cloudflarefake.MethodCreateArgoTunnel) {
+			if call.Args[0] == "failure" {
+				attempts++
+			}
+		}
+		Expect(attempts).To(Equal(2))
+	})
+
+	It("summarizes its conditions in the Ready and Degraded conditions", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("ready", "ready-a.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionReadyType), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("ObservedGeneration", tunnel.Generation),
+		))
+		tunnel, err := getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Status.ObservedGeneration).To(Equal(tunnel.Generation))
+		for _, conditionType := range []string{
+			tunnelv1alpha1.TunnelConditionCredentialsType,
+			tunnelv1alpha1.TunnelConditionCreatedType,
+			tunnelv1alpha1.TunnelConditionDNSReadyType,
+			tunnelv1alpha1.TunnelConditionConfigSyncedType,
+		} {
+			Expect(apimeta.FindStatusCondition(tunnel.Status.Conditions, conditionType)).To(And(
+				Not(BeNil()),
+				HaveField("Status", metav1.ConditionTrue),
+				HaveField("ObservedGeneration", tunnel.Generation),
+			), conditionType)
+		}
+		Expect(apimeta.IsStatusConditionFalse(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionDegradedType)).To(BeTrue())
+		Expect(apimeta.FindStatusCondition(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionConnectorAvailableType)).
+			To(HaveField("Reason", tunnelv1alpha1.TunnelConditionConnectorAvailableNotRunReason))
+
+		By("failing to create a DNS record")
+		fakeCloudflare.SetError(cloudflarefake.MethodCreateDNSRecord, &cloudflare.APIRequestError{
+			StatusCode: http.StatusInternalServerError,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1001, Message: "internal error"}},
+		})
+		defer fakeCloudflare.SetError(cloudflarefake.MethodCreateDNSRecord, nil)
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("ready", "ready-a.example.com", "ready-b.example.com").Spec.Ingress
+		})
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDNSReadyType), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionDNSReadyFailedReason),
+		))
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDegradedType), timeout, interval).
+			Should(HaveField("Status", metav1.ConditionTrue))
+		Expect(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionReadyType)()).To(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionReadyFailedReason),
+		))
+
+		By("recovering from the failure")
+		fakeCloudflare.SetError(cloudflarefake.MethodCreateDNSRecord, nil)
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionReadyType), timeout, interval).
+			Should(HaveField("Status", metav1.ConditionTrue))
+		tunnel, err = getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Status.ObservedGeneration).To(Equal(tunnel.Generation))
+		Expect(apimeta.IsStatusConditionFalse(tunnel.Status.Conditions, tunnelv1alpha1.TunnelConditionDegradedType)).To(BeTrue())
+	})
+
+	It("reports the connections of the tunnel to the cloudflare edge", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("connected", "connected.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		fakeCloudflare.SetConnections(tunnel.Status.TunnelID,
+			tunnelv1alpha1.TunnelConnection{ID: "c1", ConnectorID: "connector-a", ColoName: "cdg01", ClientVersion: "2022.3.0"},
+			tunnelv1alpha1.TunnelConnection{ID: "c2", ConnectorID: "connector-a", ColoName: "fra01", ClientVersion: "2022.3.0"},
+			tunnelv1alpha1.TunnelConnection{ID: "c3", ConnectorID: "connector-b", ColoName: "ams01", IsPendingReconnect: true},
+		)
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionConnectedType), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Message", "2 active connections from 1 connectors"),
+		))
+		tunnel, err := getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Status.ActiveConnections).To(BeEquivalentTo(2))
+		Expect(tunnel.Status.DisconnectedSince).To(BeNil())
+		Expect(tunnel.Status.Connections).To(HaveLen(3))
+		Expect(tunnel.Status.Connections[0]).To(And(
+			HaveField("ID", "c1"),
+			HaveField("ConnectorID", "connector-a"),
+			HaveField("ColoName", "cdg01"),
+		))
+
+		By("losing all the connections")
+		fakeCloudflare.SetConnections(tunnel.Status.TunnelID)
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{"test": "disconnect"}
+		})
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionConnectedType), timeout, interval).Should(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionConnectedNoneReason),
+		))
+		tunnel, err = getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Status.ActiveConnections).To(BeZero())
+		Expect(tunnel.Status.Connections).To(BeEmpty())
+		Expect(tunnel.Status.DisconnectedSince).NotTo(BeNil())
+	})
+
+	It("reports the failures to poll the connections without failing the reconciliation", func() {
+		fakeCloudflare.SetError(cloudflarefake.MethodTunnelConnections, &cloudflare.APIRequestError{
+			StatusCode: http.StatusInternalServerError,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1000, Message: "connections unavailable"}},
+		})
+		defer fakeCloudflare.SetError(cloudflarefake.MethodTunnelConnections, nil)
+		tunnel := newTestTunnel("poll-failed", "poll-failed.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionConnectedType), timeout, interval).
+			Should(PointTo(And(
+				HaveField("Status", metav1.ConditionUnknown),
+				HaveField("Reason", tunnelv1alpha1.TunnelConditionConnectedFailedReason),
+				HaveField("Message", ContainSubstring("connections unavailable")),
+			)))
+		Eventually(func() error { return k8sClient.Get(ctx, key, &appsv1.Deployment{}) }, timeout, interval).Should(Succeed())
+	})
+
+	It("emits events for the actions taken on cloudflare", func() {
+		tunnel := newTestTunnel("events", "events-a.example.com")
+		tunnel.Spec.Run = true
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElements(
+			"TunnelCreated: Created cloudflare tunnel "+tunnel.Status.TunnelID,
+			"SecretCreated: Created tunnel secret events",
+			"DNSRecordCreated: Created CNAME record events-a.example.com pointing to cloudflare tunnel "+tunnel.Status.TunnelID,
+			"DeploymentCreated: Created deployment events running cloudflared",
+		))
+
+		By("failing to create a DNS record")
+		fakeCloudflare.FailNext(cloudflarefake.MethodCreateDNSRecord, &cloudflare.APIRequestError{
+			StatusCode: http.StatusInternalServerError,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1001, Message: "internal error"}},
+		})
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Spec.Ingress = newTestTunnel("events", "events-b.example.com").Spec.Ingress
+		})
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElements(
+			ContainSubstring("CloudflareAPIError: Cloudflare CreateDNSRecord failed: "),
+			"DNSRecordCreated: Created CNAME record events-b.example.com pointing to cloudflare tunnel "+tunnel.Status.TunnelID,
+			"DNSRecordDeleted: Deleted 1 CNAME records of events-a.example.com",
+		))
+
+		By("deleting the tunnel")
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElements(
+			"DNSRecordDeleted: Deleted 1 CNAME records of events-b.example.com",
+			"TunnelDeleted: Deleted cloudflare tunnel "+tunnel.Status.TunnelID,
+		))
+	})
+
+	It("exposes metrics about the cloudflare API and the tunnels", func() {
+		creations := testutil.ToFloat64(cloudflareAPIRequests.WithLabelValues("CreateArgoTunnel"))
+		failures := testutil.ToFloat64(cloudflareAPIErrors.WithLabelValues("CreateDNSRecord", "500"))
+		fakeCloudflare.FailNext(cloudflarefake.MethodCreateDNSRecord, &cloudflare.APIRequestError{
+			StatusCode: http.StatusInternalServerError,
+			Errors:     []cloudflare.ResponseInfo{{Code: 1001, Message: "internal error"}},
+		})
+		tunnel := createdTunnel(ctx, newTestTunnel("metrics", "metrics-a.example.com", "metrics-b.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", HaveLen(2)))
+
+		Expect(testutil.ToFloat64(cloudflareAPIRequests.WithLabelValues("CreateArgoTunnel"))).To(BeNumerically(">", creations))
+		Expect(testutil.ToFloat64(cloudflareAPIErrors.WithLabelValues("CreateDNSRecord", "500"))).To(Equal(failures + 1))
+		Expect(testutil.CollectAndCount(cloudflareAPIRequestDuration)).To(BeNumerically(">", 0))
+
+		registry := prometheus.NewPedanticRegistry()
+		Expect(registry.Register(&tunnelCollector{client: k8sClient})).To(Succeed())
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				name := family.GetName()
+				for _, label := range metric.GetLabel() {
+					name += "," + label.GetName() + "=" + label.GetValue()
+				}
+				values[name] = metric.GetGauge().GetValue()
+			}
+		}
+		Expect(values["tunnel_operator_tunnels"]).To(BeNumerically(">=", 1))
+		Expect(values).To(HaveKeyWithValue("tunnel_operator_tunnel_dns_records,name=metrics,namespace=default", 2.0))
+		Expect(values["tunnel_operator_tunnel_conditions,status=True,type=TunnelCreated"]).To(BeNumerically(">=", 1))
+	})
+
+	It("requeues the reconciliations hitting the cloudflare rate limit", func() {
+		createTokenSecret(ctx, "ratelimit-token", accountSecretAPITokenKey)
+		account := newTestAccount("ratelimit", "ratelimit-token")
+		account.Spec.AccountID = rateLimitedAccountID
+		Expect(k8sClient.Create(ctx, account)).To(Succeed())
+		accountKey := types.NamespacedName{Namespace: account.Namespace, Name: account.Name}
+		Eventually(accountReadyCondition(ctx, accountKey, &tunnelv1alpha1.CloudflareAccount{}), timeout, interval).
+			Should(PointTo(HaveField("Status", metav1.ConditionTrue)))
+
+		// the first request of the tunnel is answered 429, pausing the shared transport
+		cloudflareServer.RateLimitNext(1, 2*time.Second)
+		tunnel := newTestTunnel("ratelimit", "ratelimit.example.com")
+		tunnel.Spec.AccountRef = &tunnelv1alpha1.AccountReference{Name: account.Name}
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		Expect(k8sClient.Create(ctx, tunnel)).To(Succeed())
+
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElement(
+			HavePrefix("CloudflareRateLimited: Cloudflare API rate limit reached, retrying in ")))
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.TunnelID", Not(BeEmpty())))
+		Expect(tunnelEvents(ctx, key)()).NotTo(ContainElement(HavePrefix("CloudflareAPIError")))
+	})
+
+	It("reuses the tunnels and DNS records read from cloudflare until they are written or expire", func() {
+		fake := cloudflarefake.New("cache-account")
+		zoneID := fake.AddZone("cache.example.com")
+		cache := newCloudflareCache()
+		cached := &cachingClient{client: fake, cache: cache, ttl: time.Hour}
+		other := &cachingClient{client: fake, cache: cache, ttl: time.Hour}
+		cname := cloudflare.DNSRecord{Type: "CNAME", Name: "app.cache.example.com"}
+
+		By("serving the repeated listings from the cache shared by the clients")
+		for i := 0; i < 3; i++ {
+			_, err := cached.ArgoTunnels(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = other.DNSRecords(ctx, zoneID, cname)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(fake.CallCount(cloudflarefake.MethodArgoTunnels)).To(Equal(1))
+		Expect(fake.CallCount(cloudflarefake.MethodDNSRecords)).To(Equal(1))
+
+		By("invalidating the cache on writes")
+		tunnel, err := other.CreateArgoTunnel(ctx, "cached", "c2VjcmV0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cached.ArgoTunnels(ctx)).To(ContainElement(HaveField("ID", tunnel.ID)))
+		_, err = cached.CreateDNSRecord(ctx, zoneID, cloudflareapi.DNSRecord{DNSRecord: cloudflare.DNSRecord{
+			Type: "CNAME", Name: "app.cache.example.com", Content: tunnel.ID + ".cfargotunnel.com"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.DNSRecords(ctx, zoneID, cname)).To(HaveLen(1))
+		Expect(fake.CallCount(cloudflarefake.MethodArgoTunnels)).To(Equal(2))
+		Expect(fake.CallCount(cloudflarefake.MethodDNSRecords)).To(Equal(2))
+
+		By("filtering the cached records on their content")
+		Expect(other.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{
+			Type: "CNAME", Name: "app.cache.example.com", Content: "other.cfargotunnel.com"})).To(BeEmpty())
+		Expect(fake.CallCount(cloudflarefake.MethodDNSRecords)).To(Equal(2))
+
+		By("reading again once the cache expires")
+		expiring := &cachingClient{client: fake, cache: newCloudflareCache(), ttl: time.Millisecond}
+		_, err = expiring.ArgoTunnels(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(10 * time.Millisecond)
+		_, err = expiring.ArgoTunnels(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.CallCount(cloudflarefake.MethodArgoTunnels)).To(Equal(4))
+	})
+
+	It("creates the DNS records of each hostname in its own zone", func() {
+		fakeCloudflare.AddZone("sub.example.com")
+		fakeCloudflare.AddZone("example.org")
+		tunnel := newTestTunnel("zones", "zones.example.org", "zones.sub.example.com", "explicit.sub.example.com", "zones.example.net")
+		(*tunnel.Spec.Ingress)[2].Zone = testZoneName
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+
+		Eventually(func() []string { return zoneCNAMEContents("example.org", "zones.example.org") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(func() []string { return zoneCNAMEContents("sub.example.com", "zones.sub.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(func() []string { return cnameContents("explicit.sub.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Expect(zoneCNAMEContents("sub.example.com", "explicit.sub.example.com")).To(BeEmpty())
+
+		By("reporting the hostnames without zone")
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDNSReadyType), timeout, interval).Should(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionDNSReadyNoZoneReason),
+			HaveField("Message", ContainSubstring("zones.example.net")),
+		))
+		tunnel, err := getTunnel(ctx, key)()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tunnel.Status.UnresolvedHostnames).To(ConsistOf("zones.example.net"))
+		Expect(tunnel.Status.IngressHostnames).To(ConsistOf("zones.example.org", "zones.sub.example.com", "explicit.sub.example.com"))
+		Expect(tunnel.Status.DNSZones).To(ContainElement(tunnelv1alpha1.TunnelDNSZone{
+			Hostname: "explicit.sub.example.com", ZoneID: testZoneID, ZoneName: testZoneName}))
+
+		By("deleting the records from their zone")
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			_, err := getTunnel(ctx, key)()
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(zoneCNAMEContents("example.org", "zones.example.org")).To(BeEmpty())
+		Expect(zoneCNAMEContents("sub.example.com", "zones.sub.example.com")).To(BeEmpty())
+		Expect(cnameContents("explicit.sub.example.com")).To(BeEmpty())
+	})
+
+	It("applies the DNS settings of each ingress rule", func() {
+		proxied := false
+		tunnel := newTestTunnel("dnsopts", "dnsopts-a.example.com", "dnsopts-b.example.com", "dnsopts-c.example.com")
+		(*tunnel.Spec.Ingress)[0].DNS = &tunnelv1alpha1.TunnelIngressDNS{
+			Proxied: &proxied, TTL: 300, Comment: "web frontend", Tags: []string{"team:web"},
+		}
+		(*tunnel.Spec.Ingress)[2].DNS = &tunnelv1alpha1.TunnelIngressDNS{Skip: true}
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		record := func(hostname string) func() *cloudflareapi.DNSRecord {
+			return func() *cloudflareapi.DNSRecord {
+				for _, r := range fakeCloudflare.Records(testZoneName) {
+					if r.Name == hostname {
+						return &r
+					}
+				}
+				return nil
+			}
+		}
+
+		Eventually(record("dnsopts-a.example.com"), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Proxied", PointTo(BeFalse())),
+			HaveField("TTL", 300),
+			HaveField("CommentValue()", "web frontend"),
+			HaveField("Tags", ConsistOf("team:web")),
+		))
+		Eventually(record("dnsopts-b.example.com"), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Proxied", PointTo(BeTrue())),
+			HaveField("TTL", 1),
+		))
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("dnsopts-a.example.com", "dnsopts-b.example.com")))
+		Expect(record("dnsopts-c.example.com")()).To(BeNil())
+		recordID := record("dnsopts-a.example.com")().ID
+
+		By("updating the settings of the existing record in place")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			(*t.Spec.Ingress)[0].DNS = &tunnelv1alpha1.TunnelIngressDNS{Comment: "proxied frontend"}
+		})
+		Eventually(record("dnsopts-a.example.com"), timeout, interval).Should(And(
+			HaveField("ID", recordID),
+			HaveField("Proxied", PointTo(BeTrue())),
+			HaveField("TTL", 1),
+			HaveField("CommentValue()", "proxied frontend"),
+			HaveField("Tags", BeEmpty()),
+		))
+		Eventually(tunnelEvents(ctx, key), timeout, interval).
+			Should(ContainElement("DNSRecordUpdated: Updated the settings of CNAME record dnsopts-a.example.com"))
+
+		By("leaving the records of skipped hostnames in place")
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			(*t.Spec.Ingress)[1].DNS = &tunnelv1alpha1.TunnelIngressDNS{Skip: true}
+		})
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("dnsopts-a.example.com")))
+		Expect(record("dnsopts-b.example.com")()).NotTo(BeNil())
+	})
+
+	It("claims its CNAME records and never deletes the records owned elsewhere", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("owner", "owner-a.example.com", "owner-b.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+		txtContents := func(hostname string) []string {
+			contents := []string{}
+			for _, r := range fakeCloudflare.Records(testZoneName) {
+				if r.Type == "TXT" && r.Name == ownershipRecordName(hostname) {
+					contents = append(contents, r.Content)
+				}
+			}
+			return contents
+		}
+		owner := tunnelDNSOwner(testOwnerID, tunnel)
+		Expect(owner.txtContent()).To(Equal(`"heritage=tunnel-operator,tunnel-operator/owner=envtest,tunnel-operator/resource=tunnel/default/owner"`))
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("owner-a.example.com", "owner-b.example.com")))
+		Expect(txtContents("owner-a.example.com")).To(ConsistOf(owner.txtContent()))
+		Expect(txtContents("owner-b.example.com")).To(ConsistOf(owner.txtContent()))
+
+		By("leaving in place the records claimed by another operator instance")
+		otherOwner := dnsOwner{ID: "other-cluster", Resource: owner.Resource}
+		for _, r := range fakeCloudflare.Records(testZoneName) {
+			if r.Type == "TXT" && r.Name == ownershipRecordName("owner-b.example.com") {
+				Expect(fakeCloudflare.UpdateDNSRecord(ctx, r.ZoneID, r.ID, cloudflareapi.DNSRecord{
+					DNSRecord: cloudflare.DNSRecord{Content: otherOwner.txtContent()},
+				})).To(Succeed())
+			}
+		}
+		Expect(k8sClient.Delete(ctx, tunnel)).To(Succeed())
+		Eventually(func() bool {
+			_, err := getTunnel(ctx, key)()
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(cnameContents("owner-a.example.com")).To(BeEmpty())
+		Expect(txtContents("owner-a.example.com")).To(BeEmpty())
+		Expect(cnameContents("owner-b.example.com")).To(ConsistOf(content))
+		Expect(txtContents("owner-b.example.com")).To(ConsistOf(otherOwner.txtContent()))
+	})
+
+	It("repoints its CNAME records pointed at another tunnel without drift correction", func() {
+		tunnel := createdTunnel(ctx, newTestTunnel("repoint", "repoint.example.com"))
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+		Eventually(getTunnel(ctx, key), timeout, interval).
+			Should(HaveField("Status.IngressHostnames", ConsistOf("repoint.example.com")))
+
+		other := fakeCloudflare.AddTunnel("repoint-other", "b3RoZXI=")
+		for _, r := range fakeCloudflare.Records(testZoneName) {
+			if r.Type == "CNAME" && r.Name == "repoint.example.com" {
+				Expect(fakeCloudflare.UpdateDNSRecord(ctx, testZoneID, r.ID, cloudflareapi.DNSRecord{
+					DNSRecord: cloudflare.DNSRecord{Content: other.ID + ".cfargotunnel.com"}})).To(Succeed())
+			}
+		}
+		updateTunnel(ctx, key, func(t *tunnelv1alpha1.Tunnel) {
+			t.Annotations = map[string]string{"test/trigger": "repoint"}
+		})
+
+		Eventually(func() []string { return cnameContents("repoint.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElement(
+			"DNSRecordRepaired: Repointed CNAME record repoint.example.com from cloudflare tunnel " + other.ID +
+				" to cloudflare tunnel " + tunnel.Status.TunnelID))
+		Expect(getTunnel(ctx, key)()).To(HaveField("Spec.CorrectDrift", BeFalse()))
+	})
+
+	It("repairs its CNAME records targeting deleted tunnels and reports the records of other tunnels", func() {
+		tunnel := newTestTunnel("conflict", "conflict-stale.example.com", "conflict-other.example.com")
+		tunnel.Spec.ResyncPeriod = &metav1.Duration{Duration: time.Second}
+		stale := fakeCloudflare.AddTunnel("stale", "c3RhbGU=")
+		fakeCloudflare.RemoveTunnel(stale.ID)
+		other := fakeCloudflare.AddTunnel("other", "b3RoZXI=")
+		for hostname, tunnelID := range map[string]string{
+			"conflict-stale.example.com": stale.ID,
+			"conflict-other.example.com": other.ID,
+		} {
+			_, err := fakeCloudflare.AddRecord(testZoneName, cloudflareapi.DNSRecord{DNSRecord: cloudflare.DNSRecord{
+				Type: "CNAME", Name: hostname, Content: tunnelID + ".cfargotunnel.com",
+			}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := fakeCloudflare.AddRecord(testZoneName, cloudflareapi.DNSRecord{DNSRecord: cloudflare.DNSRecord{
+			Type: "TXT", Name: ownershipRecordName("conflict-stale.example.com"),
+			Content: tunnelDNSOwner(testOwnerID, tunnel).txtContent(),
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		tunnel = createdTunnel(ctx, tunnel)
+		key := types.NamespacedName{Namespace: tunnel.Namespace, Name: tunnel.Name}
+		content := tunnel.Status.TunnelID + ".cfargotunnel.com"
+
+		Eventually(func() []string { return cnameContents("conflict-stale.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(tunnelEvents(ctx, key), timeout, interval).Should(ContainElement(
+			"DNSRecordRepaired: Repointed CNAME record conflict-stale.example.com from deleted tunnel " + stale.ID +
+				" to cloudflare tunnel " + tunnel.Status.TunnelID))
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDNSConflictType), timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionDNSConflictDetectedReason),
+			HaveField("Message", ContainSubstring("conflict-other.example.com")),
+		))
+		Expect(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDNSReadyType)()).To(And(
+			HaveField("Status", metav1.ConditionFalse),
+			HaveField("Reason", tunnelv1alpha1.TunnelConditionDNSReadyConflictReason),
+		))
+		Expect(getTunnel(ctx, key)()).To(HaveField("Status.IngressHostnames", ConsistOf("conflict-stale.example.com")))
+		Expect(cnameContents("conflict-other.example.com")).To(ConsistOf(other.ID + ".cfargotunnel.com"))
+
+		By("creating the record once the other tunnel released it")
+		for _, r := range fakeCloudflare.Records(testZoneName) {
+			if r.Name == "conflict-other.example.com" {
+				Expect(fakeCloudflare.DeleteDNSRecord(ctx, r.ZoneID, r.ID)).To(Succeed())
+			}
+		}
+		Eventually(func() []string { return cnameContents("conflict-other.example.com") }, timeout, interval).
+			Should(ConsistOf(content))
+		Eventually(tunnelCondition(ctx, key, tunnelv1alpha1.TunnelConditionDNSConflictType), timeout, interval).
+			Should(HaveField("Status", metav1.ConditionFalse))
+		Eventually(getTunnel(ctx, key), timeout, interval).Should(HaveField("Status.IngressHostnames",
+			ConsistOf("conflict-stale.example.com", "conflict-other.example.com")))
+	})
+})
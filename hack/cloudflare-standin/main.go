@@ -0,0 +1,51 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cloudflare-standin serves an in-memory cloudflare API, so that the operator can run end-to-end
+// without network access with --cloudflare-api-url=http://<bind-address>/client/v4
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/patjlm/tunnel-operator/controllers/cloudflarefake"
+)
+
+func main() {
+	var bindAddress, accountID, zones, apiToken string
+	flag.StringVar(&bindAddress, "bind-address", ":8787", "The address the API binds to.")
+	flag.StringVar(&accountID, "account-id", "standin-account", "The ID of the served cloudflare account.")
+	flag.StringVar(&zones, "zones", "example.com", "Comma separated list of the DNS zones of the account.")
+	flag.StringVar(&apiToken, "api-token", "", "The only API token accepted, all tokens are accepted when empty.")
+	flag.Parse()
+
+	account := cloudflarefake.New(accountID)
+	for _, zone := range strings.Split(zones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			account.AddZone(zone)
+		}
+	}
+	handler := cloudflarefake.NewHandler(account)
+	if apiToken != "" {
+		handler.AddToken(apiToken)
+	}
+
+	log.Printf("serving cloudflare account %s on %s%s", accountID, bindAddress, cloudflarefake.APIPath)
+	log.Fatal(http.ListenAndServe(bindAddress, handler))
+}
@@ -19,7 +19,9 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
+	"github.com/cloudflare/cloudflare-go"
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -52,11 +54,42 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var cloudflareAPIURL string
+	var cloudflareRateLimit float64
+	var cloudflareRateBurst int
+	var cloudflareCacheTTL time.Duration
+	var dnsOwnerID string
+	var cloudflaredImage string
+	var tunnelResyncPeriod time.Duration
+	var connectionsPollPeriod time.Duration
+	var disconnectedThreshold time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&cloudflareAPIURL, "cloudflare-api-url", "",
+		"The base URL of the cloudflare API, defaults to https://api.cloudflare.com/client/v4. "+
+			"This allows to run against a local API stand-in.")
+	flag.Float64Var(&cloudflareRateLimit, "cloudflare-rate-limit", controllers.DefaultCloudflareRateLimit,
+		"The number of requests per second sent to the cloudflare API, shared by all the accounts.")
+	flag.IntVar(&cloudflareRateBurst, "cloudflare-rate-burst", controllers.DefaultCloudflareRateBurst,
+		"The number of requests which can be sent at once to the cloudflare API.")
+	flag.DurationVar(&cloudflareCacheTTL, "cloudflare-cache-ttl", controllers.DefaultCloudflareCacheTTL,
+		"The time during which the tunnels and DNS records read from cloudflare are reused across reconciliations, 0 to disable. "+
+			"Changes made outside of the operator are detected after this delay.")
+	flag.StringVar(&dnsOwnerID, "dns-owner-id", controllers.DefaultDNSOwnerID,
+		"The ID of this operator instance in the TXT records claiming the DNS records it manages. "+
+			"Operator instances sharing a DNS zone must use different IDs.")
+	flag.StringVar(&cloudflaredImage, "cloudflared-image", tunnelv1alpha1.DefaultCloudflaredImage,
+		"The cloudflared image run by the Tunnels with run: true, unless overridden by their podTemplate.")
+	flag.DurationVar(&tunnelResyncPeriod, "tunnel-resync-period", controllers.DefaultResyncPeriod,
+		"The period after which tunnels and their DNS records are verified against cloudflare, 0 to disable. "+
+			"Tunnels can override it with spec.resyncPeriod.")
+	flag.DurationVar(&connectionsPollPeriod, "tunnel-connections-poll-period", controllers.DefaultConnectionsPollPeriod,
+		"The period at which the connections of tunnels to the cloudflare edge are polled, 0 to disable.")
+	flag.DurationVar(&disconnectedThreshold, "tunnel-disconnected-threshold", controllers.DefaultDisconnectedThreshold,
+		"The time after which a tunnel without any active connection is reported in its Connected condition.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -78,13 +111,44 @@ func main() {
 		os.Exit(1)
 	}
 
+	// all the cloudflare clients share the same rate limit
+	var cloudflareOptions []cloudflare.Option
+	if cloudflareAPIURL != "" {
+		cloudflareOptions = append(cloudflareOptions, cloudflare.BaseURL(cloudflareAPIURL))
+	}
+	newCloudflareClient := controllers.NewRateLimitedCloudflareClientFactory(cloudflareRateLimit, cloudflareRateBurst, cloudflareOptions...)
+
 	if err = (&controllers.TunnelReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		NewCloudflareClient:   newCloudflareClient,
+		Recorder:              mgr.GetEventRecorderFor("tunnel-controller"),
+		ResyncPeriod:          tunnelResyncPeriod,
+		ConnectionsPollPeriod: connectionsPollPeriod,
+		DisconnectedThreshold: disconnectedThreshold,
+		CloudflareCacheTTL:    cloudflareCacheTTL,
+		DNSOwnerID:            dnsOwnerID,
+		CloudflaredImage:      cloudflaredImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Tunnel")
 		os.Exit(1)
 	}
+	if err = (&controllers.CloudflareAccountReconciler{
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		NewCloudflareClient: newCloudflareClient,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CloudflareAccount")
+		os.Exit(1)
+	}
+	if err = (&controllers.ClusterCloudflareAccountReconciler{
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		NewCloudflareClient: newCloudflareClient,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterCloudflareAccount")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {